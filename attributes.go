@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// sniffLen is how much of a file is inspected to detect its MIME type
+const sniffLen = 512
+
+// FileAttributes records attributes of an ingested file. They are captured
+// when a local file is split and restored when it is reassembled.
+type FileAttributes struct {
+	// Mode and ModTime are zero for data ingested from a stream
+	Mode     os.FileMode `json:"mode,omitempty"`
+	ModTime  time.Time   `json:"modTime"`
+	Owner    *FileOwner  `json:"owner,omitempty"`
+	MIMEType string      `json:"mimeType,omitempty"`
+	// Labels are arbitrary user tags
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// FileOwner identifies the owner of a local file
+type FileOwner struct {
+	UID   int    `json:"uid"`
+	GID   int    `json:"gid"`
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+func (a *FileAttributes) clone() *FileAttributes {
+	if a == nil {
+		return &FileAttributes{}
+	}
+	c := *a
+	if a.Owner != nil {
+		owner := *a.Owner
+		c.Owner = &owner
+	}
+	if a.Labels != nil {
+		c.Labels = make(map[string]string, len(a.Labels))
+		for k, v := range a.Labels {
+			c.Labels[k] = v
+		}
+	}
+	return &c
+}
+
+// fileAttributes captures the attributes of a local file
+func fileAttributes(localPath string, info os.FileInfo) *FileAttributes {
+	return &FileAttributes{
+		Mode:     info.Mode(),
+		ModTime:  info.ModTime(),
+		Owner:    fileOwner(info),
+		MIMEType: mime.TypeByExtension(filepath.Ext(localPath)),
+	}
+}
+
+// detectMIMEType guesses a MIME type from the file name, falling back to
+// the first bytes of the contents
+func detectMIMEType(name string, head []byte) string {
+	if mimeType := mime.TypeByExtension(path.Ext(name)); mimeType != "" {
+		return mimeType
+	}
+	return http.DetectContentType(head)
+}
+
+// applyAttributes sets recorded attributes on a local file. Ownership is
+// only restored when running with the privileges to do so.
+func applyAttributes(localPath string, attrs *FileAttributes) error {
+	if attrs == nil {
+		return nil
+	}
+	if attrs.Owner != nil {
+		if err := restoreOwner(localPath, attrs.Owner); err != nil {
+			return fmt.Errorf("failed to set owner of %s: %v", localPath, err)
+		}
+	}
+	if attrs.Mode != 0 {
+		if err := os.Chmod(localPath, attrs.Mode.Perm()); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %v", localPath, err)
+		}
+	}
+	if !attrs.ModTime.IsZero() {
+		if err := os.Chtimes(localPath, attrs.ModTime, attrs.ModTime); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %v", localPath, err)
+		}
+	}
+	return nil
+}
+
+// prefixBuffer keeps the first limit bytes written to it
+type prefixBuffer struct {
+	buf   []byte
+	limit int
+}
+
+func (b *prefixBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - len(b.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		b.buf = append(b.buf, p[:room]...)
+	}
+	return len(p), nil
+}
+
+// SetLabels updates the labels of the current version of a file. Labels
+// are metadata only, so no new version is created; an empty value removes
+// a label.
+func (se *StorageEngine) SetLabels(fileName string, labels map[string]string) (*FileMetadata, error) {
+	if err := validateFileName(fileName); err != nil {
+		return nil, err
+	}
+	if err := validateLabels(labels); err != nil {
+		return nil, err
+	}
+
+	var metadata *FileMetadata
+	err := se.meta.update(func(tx *bolt.Tx) error {
+		var err error
+		if metadata, err = getFile(tx, fileName); err != nil {
+			return err
+		}
+		attrs := metadata.Attributes.clone()
+		for key, value := range labels {
+			if value == "" {
+				delete(attrs.Labels, key)
+				continue
+			}
+			if attrs.Labels == nil {
+				attrs.Labels = make(map[string]string)
+			}
+			attrs.Labels[key] = value
+		}
+		metadata.Attributes = attrs
+
+		if err := putVersion(tx, metadata); err != nil {
+			return err
+		}
+		return putFile(tx, metadata)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// validateLabels rejects labels the metadata index cannot store
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if key == "" || strings.ContainsRune(key, 0) || strings.ContainsRune(value, 0) {
+			return fmt.Errorf("invalid label %q", key)
+		}
+	}
+	return nil
+}
+
+// FileQuery selects files by their attributes. Zero fields match
+// everything.
+type FileQuery struct {
+	// Prefix limits the search to a logical directory
+	Prefix string
+	// MIMEType matches exactly, or by major type when written as "image/*"
+	MIMEType string
+	// Labels must all be present; an empty value only requires the key
+	Labels map[string]string
+	// Owner matches the owner's user name or numeric UID
+	Owner          string
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	// MinSize and MaxSize bound the file size in bytes
+	MinSize int64
+	MaxSize int64
+}
+
+// Matches reports whether metadata satisfies the query
+func (q FileQuery) Matches(metadata *FileMetadata) bool {
+	if q.Prefix != "" && !strings.HasPrefix(metadata.FileName, q.Prefix+"/") {
+		return false
+	}
+	attrs := metadata.Attributes
+	if attrs == nil {
+		attrs = &FileAttributes{}
+	}
+
+	if q.MIMEType != "" {
+		mediaType, _, _ := mime.ParseMediaType(attrs.MIMEType)
+		if major, ok := strings.CutSuffix(q.MIMEType, "/*"); ok {
+			if !strings.HasPrefix(mediaType, major+"/") {
+				return false
+			}
+		} else if mediaType != q.MIMEType {
+			return false
+		}
+	}
+	for key, value := range q.Labels {
+		actual, exists := attrs.Labels[key]
+		if !exists || (value != "" && actual != value) {
+			return false
+		}
+	}
+	if q.Owner != "" {
+		if attrs.Owner == nil || (attrs.Owner.User != q.Owner && fmt.Sprint(attrs.Owner.UID) != q.Owner) {
+			return false
+		}
+	}
+	if !q.ModifiedAfter.IsZero() && !attrs.ModTime.After(q.ModifiedAfter) {
+		return false
+	}
+	if !q.ModifiedBefore.IsZero() && !attrs.ModTime.Before(q.ModifiedBefore) {
+		return false
+	}
+	if metadata.TotalSize < q.MinSize || (q.MaxSize > 0 && metadata.TotalSize > q.MaxSize) {
+		return false
+	}
+	return true
+}
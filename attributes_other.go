@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileOwner is not supported on this platform
+func fileOwner(info os.FileInfo) *FileOwner {
+	return nil
+}
+
+// restoreOwner is not supported on this platform
+func restoreOwner(localPath string, owner *FileOwner) error {
+	return nil
+}
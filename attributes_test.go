@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAttributesRoundTrip(t *testing.T) {
+	engine := newTestEngine(t)
+
+	src := filepath.Join(t.TempDir(), "notes.txt")
+	mtime := time.Date(2023, 7, 14, 9, 30, 0, 0, time.UTC)
+	if err := os.WriteFile(src, []byte("attribute test"), 0640); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	os.Chmod(src, 0640)
+	os.Chtimes(src, mtime, mtime)
+
+	metadata, err := engine.SplitFile(src)
+	if err != nil {
+		t.Fatalf("Failed to split file: %v", err)
+	}
+	attrs := metadata.Attributes
+	if attrs == nil || attrs.Mode.Perm() != 0640 || !attrs.ModTime.Equal(mtime) {
+		t.Fatalf("Attributes not captured: %+v", attrs)
+	}
+	if attrs.MIMEType != "text/plain; charset=utf-8" {
+		t.Errorf("Expected text/plain MIME type, got %q", attrs.MIMEType)
+	}
+	if attrs.Owner != nil && attrs.Owner.UID != os.Getuid() {
+		t.Errorf("Expected owner %d, got %d", os.Getuid(), attrs.Owner.UID)
+	}
+
+	out := filepath.Join(t.TempDir(), "restored.txt")
+	if err := engine.ReassembleFile(metadata, out); err != nil {
+		t.Fatalf("Failed to reassemble file: %v", err)
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatalf("Failed to stat reassembled file: %v", err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("Attributes not restored: mode %v, mtime %v", info.Mode().Perm(), info.ModTime())
+	}
+}
+
+func TestFindFiles(t *testing.T) {
+	engine := newTestEngine(t)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 64)...)
+	if _, err := engine.Ingest(bytes.NewReader(png), "photos/cat", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if _, err := engine.Ingest(bytes.NewReader([]byte("hello")), "docs/hello.txt", IngestOptions{
+		Attributes: &FileAttributes{Labels: map[string]string{"project": "apollo"}},
+	}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	images, err := engine.FindFiles(FileQuery{MIMEType: "image/*"})
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if len(images) != 1 || images[0].FileName != "photos/cat" {
+		t.Errorf("Expected the sniffed PNG to match image/*, got %d results", len(images))
+	}
+
+	if _, err := engine.SetLabels("photos/cat", map[string]string{"project": "apollo", "animal": "cat"}); err != nil {
+		t.Fatalf("Failed to set labels: %v", err)
+	}
+	apollo, err := engine.FindFiles(FileQuery{Labels: map[string]string{"project": "apollo"}})
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if len(apollo) != 2 || apollo[0].FileName != "docs/hello.txt" {
+		t.Errorf("Expected both files labelled apollo, got %d", len(apollo))
+	}
+
+	inPhotos, _ := engine.FindFiles(FileQuery{Prefix: "photos", Labels: map[string]string{"animal": ""}})
+	if len(inPhotos) != 1 {
+		t.Errorf("Expected one labelled photo, got %d", len(inPhotos))
+	}
+
+	// Labels are kept with the version, not only the current document
+	if _, err := engine.SetLabels("photos/cat", map[string]string{"animal": ""}); err != nil {
+		t.Fatalf("Failed to remove label: %v", err)
+	}
+	version, err := engine.ReadVersion("photos/cat", 1)
+	if err != nil {
+		t.Fatalf("Failed to read version: %v", err)
+	}
+	if _, exists := version.Attributes.Labels["animal"]; exists || version.Attributes.Labels["project"] != "apollo" {
+		t.Errorf("Unexpected labels on version 1: %v", version.Attributes.Labels)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// fileOwner reads the owner of a local file
+func fileOwner(info os.FileInfo) *FileOwner {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	owner := &FileOwner{UID: int(stat.Uid), GID: int(stat.Gid)}
+	if u, err := user.LookupId(strconv.Itoa(owner.UID)); err == nil {
+		owner.User = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(owner.GID)); err == nil {
+		owner.Group = g.Name
+	}
+	return owner
+}
+
+// restoreOwner changes the owner of a local file when running as root.
+// Names are preferred over numeric IDs, which may differ between hosts.
+func restoreOwner(localPath string, owner *FileOwner) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	uid, gid := owner.UID, owner.GID
+	if u, err := user.Lookup(owner.User); err == nil && owner.User != "" {
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if g, err := user.LookupGroup(owner.Group); err == nil && owner.Group != "" {
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return os.Lchown(localPath, uid, gid)
+}
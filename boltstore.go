@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var chunksBucket = []byte("chunks")
+
+// BoltChunkStore keeps all chunks in a single BoltDB file
+type BoltChunkStore struct {
+	db *bolt.DB
+}
+
+// NewBoltChunkStore opens or creates a BoltDB chunk store at path
+func NewBoltChunkStore(path string) (*BoltChunkStore, error) {
+	db, err := bolt.Open(path, DefaultFilePerm, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(chunksBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create chunks bucket: %v", err)
+	}
+
+	return &BoltChunkStore{db: db}, nil
+}
+
+// Put stores a chunk
+func (s *BoltChunkStore) Put(hash string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(chunksBucket).Put([]byte(hash), data)
+	})
+}
+
+// Get returns a copy of a stored chunk
+func (s *BoltChunkStore) Get(hash string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(chunksBucket).Get([]byte(hash))
+		if value == nil {
+			return ErrChunkNotFound
+		}
+		// Values are only valid inside the transaction
+		data = append([]byte(nil), value...)
+		return nil
+	})
+	return data, err
+}
+
+// Has reports whether a chunk is stored
+func (s *BoltChunkStore) Has(hash string) (bool, error) {
+	var exists bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(chunksBucket).Get([]byte(hash)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// Delete removes a chunk
+func (s *BoltChunkStore) Delete(hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(chunksBucket).Delete([]byte(hash))
+	})
+}
+
+// List returns all stored hashes in key order
+func (s *BoltChunkStore) List() ([]string, error) {
+	var hashes []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(chunksBucket).ForEach(func(k, _ []byte) error {
+			hashes = append(hashes, string(k))
+			return nil
+		})
+	})
+	return hashes, err
+}
+
+// Stat returns the size of a stored chunk
+func (s *BoltChunkStore) Stat(hash string) (ChunkInfo, error) {
+	var info ChunkInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(chunksBucket).Get([]byte(hash))
+		if value == nil {
+			return ErrChunkNotFound
+		}
+		info = ChunkInfo{Hash: hash, Size: int64(len(value))}
+		return nil
+	})
+	return info, err
+}
+
+// Close closes the underlying database
+func (s *BoltChunkStore) Close() error {
+	return s.db.Close()
+}
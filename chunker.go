@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	// ChunkerFixed splits input at fixed AvgSize byte boundaries
+	ChunkerFixed = "fixed"
+	// ChunkerFastCDC splits input at content-defined boundaries using FastCDC
+	ChunkerFastCDC = "fastcdc"
+)
+
+// ChunkingParams describes how a file was split into chunks. For fixed
+// chunking only AvgSize is used and it is the exact size of every chunk
+// except the last one.
+type ChunkingParams struct {
+	Algorithm string `json:"algorithm"`
+	MinSize   int    `json:"minSize,omitempty"`
+	AvgSize   int    `json:"avgSize"`
+	MaxSize   int    `json:"maxSize,omitempty"`
+}
+
+// FixedChunking returns parameters for fixed-size chunking
+func FixedChunking(size int) ChunkingParams {
+	return ChunkingParams{Algorithm: ChunkerFixed, AvgSize: size}
+}
+
+// DefaultCDCChunking returns FastCDC parameters averaging ChunkSize chunks
+func DefaultCDCChunking() ChunkingParams {
+	return ChunkingParams{
+		Algorithm: ChunkerFastCDC,
+		MinSize:   ChunkSize / 4,
+		AvgSize:   ChunkSize,
+		MaxSize:   ChunkSize * 4,
+	}
+}
+
+// Validate checks that the parameters describe a usable chunker
+func (p ChunkingParams) Validate() error {
+	switch p.Algorithm {
+	case ChunkerFixed:
+		if p.AvgSize <= 0 || p.AvgSize > maxChunkSize {
+			return fmt.Errorf("fixed chunk size must be between 1 and %d, got %d", maxChunkSize, p.AvgSize)
+		}
+	case ChunkerFastCDC:
+		if p.MinSize <= 0 || p.MinSize > p.AvgSize || p.AvgSize > p.MaxSize || p.MaxSize > maxChunkSize {
+			return fmt.Errorf("invalid fastcdc sizes: min=%d avg=%d max=%d", p.MinSize, p.AvgSize, p.MaxSize)
+		}
+	default:
+		return fmt.Errorf("unknown chunking algorithm %q", p.Algorithm)
+	}
+	return nil
+}
+
+// Chunker splits a stream into chunks
+type Chunker interface {
+	// Next returns the next chunk or io.EOF once the input is exhausted.
+	// The returned slice is only valid until the following call.
+	Next() ([]byte, error)
+}
+
+// NewChunker creates a chunker reading from r with the given parameters
+func NewChunker(r io.Reader, params ChunkingParams) (Chunker, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch params.Algorithm {
+	case ChunkerFastCDC:
+		return newCDCChunker(r, params), nil
+	default:
+		return &fixedChunker{r: r, buf: make([]byte, params.AvgSize)}, nil
+	}
+}
+
+// fixedChunker cuts the input every len(buf) bytes
+type fixedChunker struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (c *fixedChunker) Next() ([]byte, error) {
+	n, err := io.ReadFull(c.r, c.buf)
+	if n == 0 {
+		if err == nil || err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return c.buf[:n], nil
+}
+
+// gearTable holds the random values used by the FastCDC rolling hash.
+// It is generated from a fixed seed so every node cuts identical content
+// at identical boundaries.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// cdcChunker implements FastCDC with normalized chunking: a stricter mask
+// is used before the average size and a looser one after it, which keeps
+// chunk sizes close to AvgSize.
+type cdcChunker struct {
+	r      io.Reader
+	params ChunkingParams
+	maskS  uint64
+	maskL  uint64
+
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+func newCDCChunker(r io.Reader, params ChunkingParams) *cdcChunker {
+	avgBits := bits.Len(uint(params.AvgSize)) - 1
+	return &cdcChunker{
+		r:      r,
+		params: params,
+		maskS:  highMask(avgBits + 2),
+		maskL:  highMask(avgBits - 2),
+		buf:    make([]byte, params.MaxSize),
+	}
+}
+
+// highMask returns a mask with the n most significant bits set. The gear
+// hash shifts left on every byte, so the high bits carry the most history.
+func highMask(n int) uint64 {
+	if n < 1 {
+		n = 1
+	}
+	if n > 63 {
+		n = 63
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+func (c *cdcChunker) fill() error {
+	if c.start > 0 {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+	}
+
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cdcChunker) Next() ([]byte, error) {
+	if c.end-c.start < c.params.MaxSize && !c.eof {
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the next chunk at the start of data
+func (c *cdcChunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.params.MinSize {
+		return n
+	}
+	if n > c.params.MaxSize {
+		n = c.params.MaxSize
+	}
+	normal := c.params.AvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.params.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
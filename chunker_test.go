@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkAll(t *testing.T, data []byte, params ChunkingParams) [][32]byte {
+	t.Helper()
+	chunker, err := NewChunker(bytes.NewReader(data), params)
+	if err != nil {
+		t.Fatalf("Failed to create chunker: %v", err)
+	}
+
+	var hashes [][32]byte
+	total := 0
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Chunker failed: %v", err)
+		}
+		if params.MaxSize > 0 && len(chunk) > params.MaxSize {
+			t.Errorf("Chunk of %d bytes exceeds max size %d", len(chunk), params.MaxSize)
+		}
+		total += len(chunk)
+		hashes = append(hashes, sha256.Sum256(chunk))
+	}
+	if total != len(data) {
+		t.Fatalf("Chunks cover %d bytes, expected %d", total, len(data))
+	}
+	return hashes
+}
+
+func TestFixedChunker(t *testing.T) {
+	data := make([]byte, 10*1024+7)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	hashes := chunkAll(t, data, FixedChunking(1024))
+	if len(hashes) != 11 {
+		t.Errorf("Expected 11 chunks, got %d", len(hashes))
+	}
+}
+
+func TestCDCChunkerSurvivesInsertion(t *testing.T) {
+	params := ChunkingParams{Algorithm: ChunkerFastCDC, MinSize: 2048, AvgSize: 8192, MaxSize: 32768}
+
+	original := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(2)).Read(original)
+	modified := append([]byte{0x42}, original...)
+
+	before := chunkAll(t, original, params)
+	after := chunkAll(t, modified, params)
+
+	seen := make(map[[32]byte]bool)
+	for _, h := range before {
+		seen[h] = true
+	}
+	shared := 0
+	for _, h := range after {
+		if seen[h] {
+			shared++
+		}
+	}
+
+	// Only the chunk containing the inserted byte should change
+	if shared < len(before)-2 {
+		t.Errorf("Expected almost all of %d chunks to survive an insertion, only %d did", len(before), shared)
+	}
+}
+
+func TestChunkingParamsValidate(t *testing.T) {
+	bad := []ChunkingParams{
+		{Algorithm: "rabin", AvgSize: 1024},
+		{Algorithm: ChunkerFixed},
+		{Algorithm: ChunkerFastCDC, MinSize: 4096, AvgSize: 1024, MaxSize: 8192},
+	}
+	for _, p := range bad {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", p)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Chunk states reported by InspectChunk
+const (
+	ChunkOK      = "ok"
+	ChunkCorrupt = "corrupt"
+	ChunkMissing = "missing"
+)
+
+// ChunkReference locates a chunk within one version of a file
+type ChunkReference struct {
+	FileName string `json:"fileName"`
+	Version  int    `json:"version"`
+	Current  bool   `json:"current"`
+	// Indexes lists the positions the chunk occupies in the file
+	Indexes []int `json:"indexes"`
+}
+
+// ChunkReport describes a chunk's state and every file version using it
+type ChunkReport struct {
+	Hash       string           `json:"hash"`
+	Status     string           `json:"status"`
+	Error      string           `json:"error,omitempty"`
+	References []ChunkReference `json:"references"`
+}
+
+// Files returns the distinct paths referencing the chunk
+func (r *ChunkReport) Files() []string {
+	var files []string
+	for _, ref := range r.References {
+		if len(files) == 0 || files[len(files)-1] != ref.FileName {
+			files = append(files, ref.FileName)
+		}
+	}
+	return files
+}
+
+// ChunkReferences returns every file version referencing the chunk, sorted
+// by path and version
+func (se *StorageEngine) ChunkReferences(hash string) ([]ChunkReference, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+
+	var refs []ChunkReference
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		prefix := joinKey([]byte(hash), nil)
+		return scanPrefix(tx.Bucket(chunkFilesBucket), prefix, func(k, _ []byte) (bool, error) {
+			name := string(k[len(prefix):])
+			current, err := getFile(tx, name)
+			if err != nil {
+				return false, err
+			}
+			versions, err := versionsOf(tx, name)
+			if err != nil {
+				return false, err
+			}
+			for _, metadata := range versions {
+				ref := ChunkReference{FileName: name, Version: metadata.Version, Current: metadata.Version == current.Version}
+				for i, h := range metadata.ChunkHashes {
+					if h == hash {
+						ref.Indexes = append(ref.Indexes, i)
+					}
+				}
+				if len(ref.Indexes) > 0 {
+					refs = append(refs, ref)
+				}
+			}
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up chunk %s: %v", hash, err)
+	}
+	return refs, nil
+}
+
+// InspectChunk verifies a chunk and reports which files it affects
+func (se *StorageEngine) InspectChunk(hash string) (*ChunkReport, error) {
+	refs, err := se.ChunkReferences(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ChunkReport{Hash: hash, Status: ChunkOK, References: refs}
+	if _, err := se.readChunk(hash); err != nil {
+		report.Error = err.Error()
+		switch {
+		case errors.Is(err, ErrChunkNotFound):
+			report.Status = ChunkMissing
+		case errors.Is(err, ErrChunkCorrupt):
+			report.Status = ChunkCorrupt
+		default:
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// ChunkFetcher retrieves a chunk from elsewhere, such as a peer, and stores
+// it in the engine
+type ChunkFetcher func(hash string) error
+
+// RepairReport summarises a repair run
+type RepairReport struct {
+	// Files lists the paths whose chunks were checked
+	Files []string `json:"files"`
+	// Checked counts the distinct chunks verified
+	Checked  int      `json:"checked"`
+	Repaired []string `json:"repaired,omitempty"`
+	// Failed maps chunks that could not be repaired to the reason
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// RepairAffected verifies every chunk of every version of the files
+// referencing hash, since damage to one chunk often means damage nearby,
+// and replaces missing or corrupt chunks using fetch
+func (se *StorageEngine) RepairAffected(hash string, fetch ChunkFetcher) (*RepairReport, error) {
+	refs, err := se.ChunkReferences(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{Failed: make(map[string]string)}
+	hashes := map[string]bool{hash: true}
+	for _, ref := range refs {
+		if len(report.Files) == 0 || report.Files[len(report.Files)-1] != ref.FileName {
+			report.Files = append(report.Files, ref.FileName)
+		}
+		metadata, err := se.ReadVersion(ref.FileName, ref.Version)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range metadata.ChunkHashes {
+			hashes[h] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(hashes))
+	for h := range hashes {
+		sorted = append(sorted, h)
+	}
+	sort.Strings(sorted)
+	for _, h := range sorted {
+		report.Checked++
+		repaired, err := se.repairChunk(h, fetch)
+		if err != nil {
+			report.Failed[h] = err.Error()
+		} else if repaired {
+			report.Repaired = append(report.Repaired, h)
+		}
+	}
+	return report, nil
+}
+
+// repairChunk replaces a missing or corrupt chunk, moving a corrupt copy
+// to quarantine first. It reports whether a repair was needed.
+func (se *StorageEngine) repairChunk(hash string, fetch ChunkFetcher) (bool, error) {
+	_, err := se.readChunk(hash)
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.Is(err, ErrChunkCorrupt):
+		if err := se.quarantineCorruptChunk(hash); err != nil {
+			return true, err
+		}
+	case !errors.Is(err, ErrChunkNotFound):
+		return true, err
+	}
+
+	if fetch == nil {
+		return true, fmt.Errorf("no source to repair from")
+	}
+	if err := fetch(hash); err != nil {
+		return true, err
+	}
+	_, err = se.readChunk(hash)
+	return true, err
+}
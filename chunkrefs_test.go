@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkReferencesAndRepair(t *testing.T) {
+	engine := newTestEngine(t)
+	source := newTestEngine(t)
+
+	block := bytes.Repeat([]byte("b"), 1024)
+	files := map[string][]byte{
+		"a.bin":     append(append([]byte{}, block...), block...),
+		"dir/b.bin": append(bytes.Repeat([]byte("x"), 1024), block...),
+		"unrelated": bytes.Repeat([]byte("u"), 1024),
+	}
+	for name, data := range files {
+		for _, e := range []*StorageEngine{engine, source} {
+			if _, err := e.Ingest(bytes.NewReader(data), name, IngestOptions{}); err != nil {
+				t.Fatalf("Failed to ingest %s: %v", name, err)
+			}
+		}
+	}
+	// An older version of dir/b.bin also used the block
+	if _, err := engine.Ingest(bytes.NewReader([]byte("new")), "dir/b.bin", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	hash := chunkHash(block)
+	if err := engine.chunks.Put(hash, []byte("bit rot")); err != nil {
+		t.Fatalf("Failed to corrupt chunk: %v", err)
+	}
+
+	report, err := engine.InspectChunk(hash)
+	if err != nil {
+		t.Fatalf("Failed to inspect chunk: %v", err)
+	}
+	if report.Status != ChunkCorrupt || len(report.References) != 2 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	a, b := report.References[0], report.References[1]
+	if a.FileName != "a.bin" || !a.Current || len(a.Indexes) != 2 {
+		t.Errorf("Unexpected reference: %+v", a)
+	}
+	if b.FileName != "dir/b.bin" || b.Version != 1 || b.Current || len(b.Indexes) != 1 || b.Indexes[0] != 1 {
+		t.Errorf("Unexpected reference: %+v", b)
+	}
+
+	// Lose another chunk of an affected file as well
+	xHash := chunkHash(bytes.Repeat([]byte("x"), 1024))
+	engine.chunks.Delete(xHash)
+
+	repair, err := engine.RepairAffected(hash, func(h string) error {
+		data, err := source.readChunk(h)
+		if err != nil {
+			return err
+		}
+		_, err = engine.storeChunk(h, data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if len(repair.Files) != 2 || len(repair.Repaired) != 2 || len(repair.Failed) != 0 {
+		t.Errorf("Unexpected repair report: %+v", repair)
+	}
+	if report, _ := engine.InspectChunk(hash); report.Status != ChunkOK {
+		t.Errorf("Chunk still %s after repair", report.Status)
+	}
+
+	metadata, err := engine.ReadVersion("dir/b.bin", 1)
+	if err != nil {
+		t.Fatalf("Failed to read version: %v", err)
+	}
+	if err := engine.ReassembleFile(metadata, filepath.Join(t.TempDir(), "b.bin")); err != nil {
+		t.Errorf("Repaired file unreadable: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ChunkInfo describes a stored chunk
+type ChunkInfo struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// ChunkStore persists chunk data keyed by hash. Implementations do not
+// verify contents; StorageEngine checks hashes on read. Get and Stat return
+// ErrChunkNotFound for missing chunks, and Delete of a missing chunk is not
+// an error.
+type ChunkStore interface {
+	Put(hash string, data []byte) error
+	Get(hash string) ([]byte, error)
+	Has(hash string) (bool, error)
+	Delete(hash string) error
+	List() ([]string, error)
+	Stat(hash string) (ChunkInfo, error)
+}
+
+// FSChunkStore keeps each chunk in its own file named after its hash
+type FSChunkStore struct {
+	dir  string
+	perm os.FileMode
+}
+
+// NewFSChunkStore creates a filesystem chunk store rooted at dir
+func NewFSChunkStore(dir string) (*FSChunkStore, error) {
+	return newFSChunkStore(dir, DefaultFilePerm, DefaultDirPerm)
+}
+
+func newFSChunkStore(dir string, filePerm, dirPerm os.FileMode) (*FSChunkStore, error) {
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	return &FSChunkStore{dir: dir, perm: filePerm}, nil
+}
+
+func (s *FSChunkStore) path(hash string) string {
+	return filepath.Join(s.dir, hash)
+}
+
+// Put writes a chunk file atomically
+func (s *FSChunkStore) Put(hash string, data []byte) error {
+	return writeFileAtomic(s.path(hash), data, s.perm)
+}
+
+// Get reads a chunk file
+func (s *FSChunkStore) Get(hash string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrChunkNotFound
+	}
+	return data, err
+}
+
+// Has reports whether a chunk file exists
+func (s *FSChunkStore) Has(hash string) (bool, error) {
+	_, err := os.Stat(s.path(hash))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Delete removes a chunk file
+func (s *FSChunkStore) Delete(hash string) error {
+	err := os.Remove(s.path(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the hashes of all chunk files
+func (s *FSChunkStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || validateHash(entry.Name()) != nil {
+			continue
+		}
+		hashes = append(hashes, entry.Name())
+	}
+	return hashes, nil
+}
+
+// Stat returns the size of a chunk file
+func (s *FSChunkStore) Stat(hash string) (ChunkInfo, error) {
+	info, err := os.Stat(s.path(hash))
+	if os.IsNotExist(err) {
+		return ChunkInfo{}, ErrChunkNotFound
+	}
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	return ChunkInfo{Hash: hash, Size: info.Size()}, nil
+}
+
+// MemoryChunkStore keeps chunks in memory, mainly for tests
+type MemoryChunkStore struct {
+	chunks map[string][]byte
+	mu     sync.RWMutex
+}
+
+// NewMemoryChunkStore creates an empty in-memory chunk store
+func NewMemoryChunkStore() *MemoryChunkStore {
+	return &MemoryChunkStore{
+		chunks: make(map[string][]byte),
+	}
+}
+
+// Put stores a copy of data
+func (s *MemoryChunkStore) Put(hash string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks[hash] = append([]byte(nil), data...)
+	return nil
+}
+
+// Get returns a copy of the stored chunk
+func (s *MemoryChunkStore) Get(hash string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, exists := s.chunks[hash]
+	if !exists {
+		return nil, ErrChunkNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// Has reports whether a chunk is stored
+func (s *MemoryChunkStore) Has(hash string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists := s.chunks[hash]
+	return exists, nil
+}
+
+// Delete removes a chunk
+func (s *MemoryChunkStore) Delete(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.chunks, hash)
+	return nil
+}
+
+// List returns the stored hashes in sorted order
+func (s *MemoryChunkStore) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hashes := make([]string, 0, len(s.chunks))
+	for hash := range s.chunks {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+// Stat returns the size of a stored chunk
+func (s *MemoryChunkStore) Stat(hash string) (ChunkInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, exists := s.chunks[hash]
+	if !exists {
+		return ChunkInfo{}, ErrChunkNotFound
+	}
+	return ChunkInfo{Hash: hash, Size: int64(len(data))}, nil
+}
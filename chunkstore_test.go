@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func testChunkStore(t *testing.T, store ChunkStore) {
+	data := []byte("chunk store contents")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	if has, err := store.Has(hash); err != nil || has {
+		t.Fatalf("Expected empty store, Has returned %v, %v", has, err)
+	}
+	if _, err := store.Get(hash); !errors.Is(err, ErrChunkNotFound) {
+		t.Errorf("Expected ErrChunkNotFound from Get, got %v", err)
+	}
+	if _, err := store.Stat(hash); !errors.Is(err, ErrChunkNotFound) {
+		t.Errorf("Expected ErrChunkNotFound from Stat, got %v", err)
+	}
+
+	if err := store.Put(hash, data); err != nil {
+		t.Fatalf("Failed to put chunk: %v", err)
+	}
+	got, err := store.Get(hash)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get returned %q, %v", got, err)
+	}
+	if info, err := store.Stat(hash); err != nil || info.Size != int64(len(data)) {
+		t.Errorf("Stat returned %+v, %v", info, err)
+	}
+	if hashes, err := store.List(); err != nil || len(hashes) != 1 || hashes[0] != hash {
+		t.Errorf("List returned %v, %v", hashes, err)
+	}
+
+	if err := store.Delete(hash); err != nil {
+		t.Fatalf("Failed to delete chunk: %v", err)
+	}
+	if has, _ := store.Has(hash); has {
+		t.Error("Chunk still present after Delete")
+	}
+	if err := store.Delete(hash); err != nil {
+		t.Errorf("Deleting a missing chunk should succeed, got %v", err)
+	}
+}
+
+func TestFSChunkStore(t *testing.T) {
+	store, err := NewFSChunkStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	testChunkStore(t, store)
+}
+
+func TestMemoryChunkStore(t *testing.T) {
+	testChunkStore(t, NewMemoryChunkStore())
+}
+
+func TestBoltChunkStore(t *testing.T) {
+	store, err := NewBoltChunkStore(filepath.Join(t.TempDir(), "chunks.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+	testChunkStore(t, store)
+}
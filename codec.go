@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	// CodecNone stores chunks uncompressed
+	CodecNone = "none"
+	// CodecGzip compresses chunks with gzip
+	CodecGzip = "gzip"
+	// CodecZlib compresses chunks with zlib
+	CodecZlib = "zlib"
+)
+
+// maxChunkSize bounds the decompressed size of a chunk, so a small
+// compressed payload from a peer cannot expand without limit. It matches
+// the largest payload a frame can carry uncompressed.
+const maxChunkSize = maxFrameSize
+
+// chunkMagic starts every compressed chunk as stored. It is followed by one
+// byte holding the codec name length, the codec name and the payload.
+// Uncompressed chunks are stored as-is, so chunks written before
+// compression existed remain readable.
+var chunkMagic = []byte("\x00DFSZ")
+
+// Codec compresses chunk data. Chunk hashes are always computed over the
+// uncompressed bytes, so the codec never affects deduplication.
+type Codec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	codecs   = make(map[string]Codec)
+	codecsMu sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(zlibCodec{})
+}
+
+// RegisterCodec makes a codec available by name, replacing any codec
+// already registered under that name
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// lookupCodec returns the registered codec with the given name
+func lookupCodec(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, exists := codecs[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return codec, nil
+}
+
+// registeredCodecs returns the names of all registered codecs
+func registeredCodecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateCodec checks that name is CodecNone or a registered codec
+func validateCodec(name string) error {
+	if name == CodecNone {
+		return nil
+	}
+	_, err := lookupCodec(name)
+	return err
+}
+
+// encodeChunk compresses data with the named codec and wraps it for
+// storage. Data that does not shrink is stored uncompressed. It returns
+// the stored bytes and the codec actually used.
+func encodeChunk(codecName string, data []byte) ([]byte, string, error) {
+	if codecName == "" || codecName == CodecNone {
+		return data, CodecNone, nil
+	}
+
+	codec, err := lookupCodec(codecName)
+	if err != nil {
+		return nil, "", err
+	}
+	compressed, err := codec.Compress(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to compress chunk with %s: %v", codecName, err)
+	}
+
+	stored := wrapChunk(codecName, compressed)
+	if len(stored) >= len(data) {
+		return data, CodecNone, nil
+	}
+	return stored, codecName, nil
+}
+
+// wrapChunk prefixes an already compressed payload with the chunk header
+func wrapChunk(codecName string, payload []byte) []byte {
+	stored := make([]byte, 0, len(chunkMagic)+1+len(codecName)+len(payload))
+	stored = append(stored, chunkMagic...)
+	stored = append(stored, byte(len(codecName)))
+	stored = append(stored, codecName...)
+	return append(stored, payload...)
+}
+
+// unwrapChunk splits stored bytes into codec name and payload. Chunks
+// without a recognised header are reported as CodecNone.
+func unwrapChunk(stored []byte) (string, []byte) {
+	if !bytes.HasPrefix(stored, chunkMagic) || len(stored) <= len(chunkMagic) {
+		return CodecNone, stored
+	}
+	nameLen := int(stored[len(chunkMagic)])
+	start := len(chunkMagic) + 1
+	if nameLen == 0 || len(stored) < start+nameLen {
+		return CodecNone, stored
+	}
+	return string(stored[start : start+nameLen]), stored[start+nameLen:]
+}
+
+// decodePayload decompresses a payload produced by the named codec
+func decodePayload(codecName string, payload []byte) ([]byte, error) {
+	if codecName == CodecNone {
+		return payload, nil
+	}
+	codec, err := lookupCodec(codecName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := codec.Decompress(payload)
+	if err != nil {
+		return nil, err
+	}
+	// Registered codecs may not bound their output themselves
+	if len(data) > maxChunkSize {
+		return nil, errChunkTooLarge
+	}
+	return data, nil
+}
+
+var errChunkTooLarge = fmt.Errorf("%w: decompressed chunk exceeds %d bytes", ErrChunkCorrupt, maxChunkSize)
+
+// readChunkData reads decompressed chunk contents, failing once they
+// exceed maxChunkSize
+func readChunkData(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxChunkSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxChunkSize {
+		return nil, errChunkTooLarge
+	}
+	return data, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return CodecGzip }
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readChunkData(r)
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) Name() string { return CodecZlib }
+
+func (zlibCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readChunkData(r)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressedChunksRoundTrip(t *testing.T) {
+	engine, err := NewStorageEngineWithOptions(StorageOptions{
+		RootDir:     t.TempDir(),
+		ChunkStore:  NewMemoryChunkStore(),
+		Compression: CodecGzip,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("highly compressible text "), 10000)
+	metadata, err := engine.Ingest(bytes.NewReader(data), "text.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if len(metadata.ChunkCodecs) != 1 || metadata.ChunkCodecs[0] != CodecGzip {
+		t.Fatalf("Expected gzip codec recorded, got %v", metadata.ChunkCodecs)
+	}
+
+	info, err := engine.chunks.Stat(metadata.ChunkHashes[0])
+	if err != nil {
+		t.Fatalf("Failed to stat chunk: %v", err)
+	}
+	if info.Size >= int64(len(data)) {
+		t.Errorf("Stored chunk is %d bytes, expected less than %d", info.Size, len(data))
+	}
+
+	output := filepath.Join(t.TempDir(), "text.txt")
+	if err := engine.ReassembleFile(metadata, output); err != nil {
+		t.Fatalf("Failed to reassemble: %v", err)
+	}
+
+	// Re-ingesting the same content with compression disabled still dedups
+	engine.compression = CodecNone
+	again, err := engine.Ingest(bytes.NewReader(data), "copy.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if again.Stats.DedupChunks != 1 || again.ChunkCodecs[0] != CodecGzip {
+		t.Errorf("Expected dedup against the gzip chunk: %+v %v", again.Stats, again.ChunkCodecs)
+	}
+}
+
+func TestIncompressibleChunksStoredRaw(t *testing.T) {
+	stored, codec, err := encodeChunk(CodecZlib, []byte{0x01})
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if codec != CodecNone || !bytes.Equal(stored, []byte{0x01}) {
+		t.Errorf("Expected raw storage for incompressible data, got %s %v", codec, stored)
+	}
+}
+
+func TestDecompressionBounded(t *testing.T) {
+	for _, name := range []string{CodecGzip, CodecZlib} {
+		codec, err := lookupCodec(name)
+		if err != nil {
+			t.Fatalf("Failed to look up %s: %v", name, err)
+		}
+		// A small payload that expands past the chunk size limit
+		bomb, err := codec.Compress(make([]byte, maxChunkSize+1))
+		if err != nil {
+			t.Fatalf("Failed to compress: %v", err)
+		}
+		if _, err := decodePayload(name, bomb); !errors.Is(err, ErrChunkCorrupt) {
+			t.Errorf("Expected %s bomb to be rejected as corrupt, got %v", name, err)
+		}
+
+		payload, err := codec.Compress(make([]byte, 4096))
+		if err != nil {
+			t.Fatalf("Failed to compress: %v", err)
+		}
+		if data, err := decodePayload(name, payload); err != nil || len(data) != 4096 {
+			t.Errorf("Failed to decode %s payload: %d bytes, %v", name, len(data), err)
+		}
+	}
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+    "errors"
     "net"
     "sync"
 )
@@ -13,9 +14,13 @@ type Connection struct {
    
 }
 
-// ConnectionManager manages peer connections
+// ConnectionManager manages peer connections: those accepted from peers,
+// and one pooled outgoing session per peer that requests share
 type ConnectionManager struct {
     connections map[string]*Connection
+    sessions    map[string]*peerSession
+    // jsonWire makes new sessions speak JSON instead of the binary protocol
+    jsonWire    bool
     mu          sync.RWMutex
 }
 
@@ -23,9 +28,75 @@ type ConnectionManager struct {
 func NewConnectionManager() *ConnectionManager {
     return &ConnectionManager{
         connections: make(map[string]*Connection),
+        sessions:    make(map[string]*peerSession),
     }
 }
 
+// Request sends msg to a peer over its pooled session, connecting first if
+// there is none, and waits for the response
+func (cm *ConnectionManager) Request(peerAddr string, msg *Message) (*Message, error) {
+    session, reused, err := cm.session(peerAddr)
+    if err != nil {
+        return nil, err
+    }
+    response, err := session.roundTrip(msg)
+    if err != nil && reused && errors.Is(err, errSessionClosed) && readOnly(MessageType(msg.Type)) {
+        // The pooled connection died while idle; try once on a new one.
+        // Requests with side effects may have reached the peer, so they
+        // are left to the caller.
+        if session, _, err = cm.session(peerAddr); err != nil {
+            return nil, err
+        }
+        response, err = session.roundTrip(msg)
+    }
+    return response, err
+}
+
+// readOnly reports whether a request of type t can be sent again without
+// changing anything on the peer
+func readOnly(t MessageType) bool {
+    switch t {
+    case Ping, FileRequest, ChunkRequestMessage, ListRequest, HaveRequest:
+        return true
+    }
+    return false
+}
+
+// session returns the live session to a peer, dialing one if needed, and
+// whether it was already pooled
+func (cm *ConnectionManager) session(peerAddr string) (*peerSession, bool, error) {
+    cm.mu.RLock()
+    session := cm.sessions[peerAddr]
+    jsonWire := cm.jsonWire
+    cm.mu.RUnlock()
+    if session != nil && !session.closed() {
+        return session, true, nil
+    }
+
+    conn, err := dialPeer(peerAddr, jsonWire)
+    if err != nil {
+        return nil, false, err
+    }
+    fresh := newPeerSession(conn, peerAddr)
+
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    // Another request may have connected meanwhile
+    if session := cm.sessions[peerAddr]; session != nil && !session.closed() {
+        fresh.close()
+        return session, true, nil
+    }
+    cm.sessions[peerAddr] = fresh
+    return fresh, false, nil
+}
+
+// SetJSONWire makes sessions opened from now on speak JSON
+func (cm *ConnectionManager) SetJSONWire(enabled bool) {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    cm.jsonWire = enabled
+}
+
 // AddConnection adds a new connection
 func (cm *ConnectionManager) AddConnection(conn net.Conn) {
     cm.mu.Lock()
@@ -47,4 +118,17 @@ func (cm *ConnectionManager) GetConnection(addr string) *Connection {
     cm.mu.RLock()
     defer cm.mu.RUnlock()
     return cm.connections[addr]
-}
\ No newline at end of file
+}
+
+// CloseAll closes every pooled session and accepted connection
+func (cm *ConnectionManager) CloseAll() {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    for peerAddr, session := range cm.sessions {
+        session.close()
+        delete(cm.sessions, peerAddr)
+    }
+    for _, conn := range cm.connections {
+        conn.Conn.Close()
+    }
+}
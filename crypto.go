@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// EncryptionNone stores chunks in plaintext
+	EncryptionNone = "none"
+	// EncryptionConvergent derives each chunk key from the chunk contents
+	// and a keyring secret, so identical chunks still deduplicate
+	EncryptionConvergent = "convergent"
+	// EncryptionPerFile encrypts every chunk of a file with one random key
+	EncryptionPerFile = "per-file"
+
+	// convergenceKeyID names the keyring secret mixed into convergent keys
+	convergenceKeyID = "convergence"
+	keySize          = 32
+)
+
+// ErrKeyNotFound is returned when a keyring has no key with the given ID
+var ErrKeyNotFound = errors.New("key not found")
+
+// EncryptionInfo records how a file's chunks were encrypted. ChunkHashes of
+// an encrypted file address the ciphertext.
+//
+// In convergent mode KeyHashes holds, for each chunk, the hash of the exact
+// bytes that were sealed, compressed encoding included; the chunk's key and
+// nonce are derived from it. These hashes are not encrypted, so anyone who
+// can read the metadata can tell whether a file contains a chunk they
+// already know, under the same codec. That is the price of deduplicating
+// encrypted chunks; use per-file mode when it matters.
+type EncryptionInfo struct {
+	Mode      string   `json:"mode"`
+	KeyID     string   `json:"keyId"`
+	KeyHashes []string `json:"keyHashes,omitempty"`
+}
+
+// Keyring stores the keys needed to decrypt files
+type Keyring interface {
+	Key(id string) ([]byte, error)
+	AddKey(id string, key []byte) error
+}
+
+// MemoryKeyring keeps keys in memory
+type MemoryKeyring struct {
+	keys map[string][]byte
+	mu   sync.RWMutex
+}
+
+// NewMemoryKeyring creates an empty in-memory keyring
+func NewMemoryKeyring() *MemoryKeyring {
+	return &MemoryKeyring{keys: make(map[string][]byte)}
+}
+
+// Key returns the key with the given ID
+func (k *MemoryKeyring) Key(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, exists := k.keys[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+// AddKey stores a key under id
+func (k *MemoryKeyring) AddKey(id string, key []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = append([]byte(nil), key...)
+	return nil
+}
+
+// LocalKeyring keeps keys hex encoded in a JSON file readable only by the
+// owner
+type LocalKeyring struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewLocalKeyring returns a keyring backed by the file at path. The file,
+// and its directory, are created on the first AddKey.
+func NewLocalKeyring(path string) *LocalKeyring {
+	return &LocalKeyring{path: path}
+}
+
+func (k *LocalKeyring) load() (map[string]string, error) {
+	keys := make(map[string]string)
+	data, err := os.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %v", err)
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal keyring: %v", err)
+	}
+	return keys, nil
+}
+
+// Key returns the key with the given ID
+func (k *LocalKeyring) Key(id string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	encoded, exists := keys[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	return hex.DecodeString(encoded)
+}
+
+// AddKey stores a key under id
+func (k *LocalKeyring) AddKey(id string, key []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys, err := k.load()
+	if err != nil {
+		return err
+	}
+	keys[id] = hex.EncodeToString(key)
+
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return fmt.Errorf("failed to marshal keyring: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return fmt.Errorf("failed to create keyring directory: %v", err)
+	}
+	return writeFileAtomic(k.path, data, 0600)
+}
+
+// validateEncryption checks that mode is a known encryption mode
+func validateEncryption(mode string) error {
+	switch mode {
+	case EncryptionNone, EncryptionConvergent, EncryptionPerFile:
+		return nil
+	default:
+		return fmt.Errorf("unknown encryption mode %q", mode)
+	}
+}
+
+// chunkSealer encrypts and decrypts the chunks of one file with AES-GCM
+type chunkSealer struct {
+	info *EncryptionInfo
+	// key is the file key in per-file mode and the convergence secret in
+	// convergent mode
+	key []byte
+}
+
+// newChunkSealer prepares encryption for a new file, creating the file key
+// or convergence secret in the keyring as needed
+func (se *StorageEngine) newChunkSealer(mode string) (*chunkSealer, error) {
+	info := &EncryptionInfo{Mode: mode}
+	switch mode {
+	case EncryptionConvergent:
+		info.KeyID = convergenceKeyID
+		key, err := se.keyring.Key(convergenceKeyID)
+		if errors.Is(err, ErrKeyNotFound) {
+			key, err = randomBytes(keySize)
+			if err == nil {
+				err = se.keyring.AddKey(convergenceKeyID, key)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load convergence secret: %v", err)
+		}
+		return &chunkSealer{info: info, key: key}, nil
+
+	case EncryptionPerFile:
+		id, err := randomBytes(16)
+		if err != nil {
+			return nil, err
+		}
+		key, err := randomBytes(keySize)
+		if err != nil {
+			return nil, err
+		}
+		info.KeyID = "file-" + hex.EncodeToString(id)
+		if err := se.keyring.AddKey(info.KeyID, key); err != nil {
+			return nil, fmt.Errorf("failed to store file key: %v", err)
+		}
+		return &chunkSealer{info: info, key: key}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown encryption mode %q", mode)
+	}
+}
+
+// openChunkSealer loads the keys needed to decrypt an existing file
+func (se *StorageEngine) openChunkSealer(info *EncryptionInfo) (*chunkSealer, error) {
+	key, err := se.keyring.Key(info.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key for %s encryption: %w", info.Mode, err)
+	}
+	return &chunkSealer{info: info, key: key}, nil
+}
+
+// seal encrypts a stored chunk encoding. In convergent mode the key is
+// derived from the hash of plaintext, which is recorded in KeyHashes.
+func (s *chunkSealer) seal(plaintext []byte) ([]byte, error) {
+	if s.info.Mode == EncryptionConvergent {
+		keyHash := chunkHash(plaintext)
+		key := convergentKey(s.key, keyHash)
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		// Keys come from the hash of the very bytes sealed, so every key
+		// encrypts exactly one plaintext and a nonce derived from the key
+		// is never reused, while ciphertexts stay identical
+		s.info.KeyHashes = append(s.info.KeyHashes, keyHash)
+		return aead.Seal(nil, convergentNonce(key, aead.NonceSize()), plaintext, nil), nil
+	}
+
+	aead, err := newAEAD(s.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts the chunk at index of the file
+func (s *chunkSealer) open(ciphertext []byte, index int) ([]byte, error) {
+	if s.info.Mode == EncryptionConvergent {
+		if index >= len(s.info.KeyHashes) {
+			return nil, fmt.Errorf("no key hash recorded for chunk %d", index)
+		}
+		key := convergentKey(s.key, s.info.KeyHashes[index])
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		return aead.Open(nil, convergentNonce(key, aead.NonceSize()), ciphertext, nil)
+	}
+
+	aead, err := newAEAD(s.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func convergentKey(secret []byte, keyHash string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(keyHash))
+	return mac.Sum(nil)
+}
+
+func convergentNonce(key []byte, size int) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("nonce"))
+	return mac.Sum(nil)[:size]
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate random bytes: %v", err)
+	}
+	return b, nil
+}
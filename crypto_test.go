@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func newEncryptedEngine(t *testing.T, mode string, keyring Keyring) *StorageEngine {
+	t.Helper()
+	engine, err := NewStorageEngineWithOptions(StorageOptions{
+		RootDir:     t.TempDir(),
+		ChunkSize:   1024,
+		ChunkStore:  NewMemoryChunkStore(),
+		Compression: CodecGzip,
+		Encryption:  mode,
+		Keyring:     keyring,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	return engine
+}
+
+func readAll(t *testing.T, engine *StorageEngine, metadata *FileMetadata) []byte {
+	t.Helper()
+	reader, err := engine.OpenMetadata(metadata)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	return data
+}
+
+func TestConvergentEncryption(t *testing.T) {
+	engine := newEncryptedEngine(t, EncryptionConvergent, NewMemoryKeyring())
+
+	plaintext := bytes.Repeat([]byte("secret report line\n"), 200)
+	first, err := engine.Ingest(bytes.NewReader(plaintext), "a.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	second, err := engine.Ingest(bytes.NewReader(plaintext), "b.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	if second.Stats.NewChunks != 0 {
+		t.Errorf("Convergent encryption should deduplicate identical content: %+v", second.Stats)
+	}
+	for _, hash := range first.ChunkHashes {
+		stored, _ := engine.chunks.Get(hash)
+		if bytes.Contains(stored, []byte("secret report")) {
+			t.Fatal("Chunk stored in plaintext")
+		}
+	}
+	if !bytes.Equal(readAll(t, engine, second), plaintext) {
+		t.Error("Decrypted content doesn't match original")
+	}
+}
+
+func TestPerFileEncryption(t *testing.T) {
+	keyring := NewMemoryKeyring()
+	engine := newEncryptedEngine(t, EncryptionNone, keyring)
+
+	plaintext := []byte("per-file encrypted contents")
+	first, err := engine.Ingest(bytes.NewReader(plaintext), "a.txt", IngestOptions{Encryption: EncryptionPerFile})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	second, err := engine.Ingest(bytes.NewReader(plaintext), "b.txt", IngestOptions{Encryption: EncryptionPerFile})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	if first.Encryption.KeyID == second.Encryption.KeyID || first.ChunkHashes[0] == second.ChunkHashes[0] {
+		t.Error("Per-file encryption should use distinct keys and ciphertexts")
+	}
+	if !bytes.Equal(readAll(t, engine, first), plaintext) {
+		t.Error("Decrypted content doesn't match original")
+	}
+
+	// Without the key the file can't be opened
+	engine.keyring = NewMemoryKeyring()
+	if _, err := engine.OpenMetadata(first); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestLocalKeyring(t *testing.T) {
+	// The default keyring lives in a state directory that doesn't exist yet
+	opts := StorageOptions{RootDir: t.TempDir(), ChunkStore: NewMemoryChunkStore()}
+	engine, err := NewStorageEngineWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	plaintext := []byte("kept under a local key")
+	metadata, err := engine.Ingest(bytes.NewReader(plaintext), "a.txt", IngestOptions{Encryption: EncryptionPerFile})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	engine.Close()
+
+	// The key survives reopening the engine
+	reopened, err := NewStorageEngineWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage engine: %v", err)
+	}
+	defer reopened.Close()
+	if !bytes.Equal(readAll(t, reopened, metadata), plaintext) {
+		t.Error("Decrypted content doesn't match original")
+	}
+}
+
+func TestConvergentKeysFollowSealedBytes(t *testing.T) {
+	keyring := NewMemoryKeyring()
+	store := NewMemoryChunkStore()
+	newEngine := func(compression string) *StorageEngine {
+		engine, err := NewStorageEngineWithOptions(StorageOptions{
+			RootDir:     t.TempDir(),
+			ChunkSize:   1024,
+			ChunkStore:  store,
+			Compression: compression,
+			Encryption:  EncryptionConvergent,
+			Keyring:     keyring,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create storage engine: %v", err)
+		}
+		return engine
+	}
+
+	// One chunk sealed once compressed and once raw must not share a key
+	// and nonce
+	plaintext := bytes.Repeat([]byte("compressible "), 70)
+	compressed, err := newEngine(CodecGzip).Ingest(bytes.NewReader(plaintext), "a.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	rawEngine := newEngine(CodecNone)
+	raw, err := rawEngine.Ingest(bytes.NewReader(plaintext), "a.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if compressed.Encryption.KeyHashes[0] == raw.Encryption.KeyHashes[0] {
+		t.Error("Different sealed bytes were given the same key")
+	}
+	if raw.Encryption.KeyHashes[0] != chunkHash(plaintext) {
+		t.Error("Key hash doesn't cover the sealed bytes")
+	}
+	if !bytes.Equal(readAll(t, rawEngine, compressed), plaintext) || !bytes.Equal(readAll(t, rawEngine, raw), plaintext) {
+		t.Error("Decrypted content doesn't match original")
+	}
+}
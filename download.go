@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	defaultDownloadConcurrency = 8
+	defaultDownloadRetries     = 3
+	defaultDownloadBackoff     = 100 * time.Millisecond
+)
+
+// DownloadOptions controls how a file's chunks are fetched
+type DownloadOptions struct {
+	// ExpectedRoot is a Merkle root obtained from a trusted source; empty
+	// trusts the root in the peer's metadata
+	ExpectedRoot string
+	// Concurrency is the number of chunk requests kept in flight
+	Concurrency int
+	// Retries is how many times a failed chunk is requested again;
+	// negative disables retrying
+	Retries int
+	// Backoff is the wait before the first retry of a chunk, doubling with
+	// each further retry
+	Backoff time.Duration
+	// Progress is called after each chunk is stored. Calls are never
+	// concurrent, but chunks complete out of order.
+	Progress func(DownloadProgress)
+}
+
+// DownloadProgress reports a download after a chunk completes
+type DownloadProgress struct {
+	FileName string
+	// Chunk is the index of the chunk just stored
+	Chunk       int
+	ChunksDone  int
+	ChunksTotal int
+	BytesDone   int64
+	BytesTotal  int64
+}
+
+func (o DownloadOptions) withDefaults() DownloadOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultDownloadConcurrency
+	}
+	if o.Retries == 0 {
+		o.Retries = defaultDownloadRetries
+	}
+	if o.Retries < 0 {
+		o.Retries = 0
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = defaultDownloadBackoff
+	}
+	return o
+}
+
+// retryable reports whether fetching a chunk again might succeed. Missing
+// chunks, refused requests and bad proofs are not retried.
+func retryable(err error) bool {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrChunkNotFound),
+		errors.Is(err, ErrBadRequest), errors.Is(err, ErrUnauthorized),
+		errors.Is(err, ErrInvalidProof), errors.Is(err, ErrInvalidHash):
+		return false
+	}
+	return true
+}
+
+type chunkResult struct {
+	index int
+	err   error
+}
+
+// downloadChunks fetches every chunk of a file, keeping up to
+// opts.Concurrency requests in flight. Chunks are stored by hash as they
+// arrive, so their order only matters when the file is reassembled. The
+// first chunk to fail for good stops new requests, and its error is
+// returned once those in flight finish.
+func downloadChunks(metadata *FileMetadata, opts DownloadOptions, fetch func(index int) error) error {
+	opts = opts.withDefaults()
+	progress := DownloadProgress{FileName: metadata.FileName, ChunksTotal: len(metadata.ChunkHashes)}
+	for _, size := range metadata.ChunkSizes {
+		progress.BytesTotal += size
+	}
+
+	// stop cuts short the backoff of chunks being retried once the
+	// download has failed
+	stop := make(chan struct{})
+	results := make(chan chunkResult, opts.Concurrency)
+	next, inflight := 0, 0
+	var firstErr error
+	for inflight > 0 || (firstErr == nil && next < progress.ChunksTotal) {
+		for firstErr == nil && next < progress.ChunksTotal && inflight < opts.Concurrency {
+			go func(index int) {
+				results <- chunkResult{index, fetchWithRetry(opts, stop, func() error { return fetch(index) })}
+			}(next)
+			next++
+			inflight++
+		}
+
+		result := <-results
+		inflight--
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to request chunk %s: %w", metadata.ChunkHashes[result.index], result.err)
+				close(stop)
+			}
+			continue
+		}
+		progress.Chunk = result.index
+		progress.ChunksDone++
+		if result.index < len(metadata.ChunkSizes) {
+			progress.BytesDone += metadata.ChunkSizes[result.index]
+		}
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+	return firstErr
+}
+
+// fetchWithRetry calls fetch until it succeeds, fails for good or runs out
+// of retries, waiting longer before each retry. It gives up early when stop
+// closes.
+func fetchWithRetry(opts DownloadOptions, stop <-chan struct{}, fetch func() error) error {
+	backoff := opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := fetch()
+		if err == nil || attempt >= opts.Retries || !retryable(err) {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-stop:
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testDownloadMetadata(chunks int) *FileMetadata {
+	metadata := &FileMetadata{FileName: "download.bin"}
+	for i := 0; i < chunks; i++ {
+		metadata.ChunkHashes = append(metadata.ChunkHashes, chunkHash([]byte(fmt.Sprint(i))))
+		metadata.ChunkSizes = append(metadata.ChunkSizes, int64(100+i))
+	}
+	return metadata
+}
+
+func TestDownloadChunks(t *testing.T) {
+	metadata := testDownloadMetadata(40)
+
+	var inflight, peak atomic.Int32
+	var mu sync.Mutex
+	attempts := make(map[int]int)
+	var reports []DownloadProgress
+	opts := DownloadOptions{
+		Concurrency: 4,
+		Backoff:     time.Millisecond,
+		Progress: func(p DownloadProgress) {
+			reports = append(reports, p)
+		},
+	}
+	err := downloadChunks(metadata, opts, func(index int) error {
+		current := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			old := peak.Load()
+			if current <= old || peak.CompareAndSwap(old, current) {
+				break
+			}
+		}
+		// Later chunks finish first
+		time.Sleep(time.Duration(40-index) * 100 * time.Microsecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[index]++
+		// Every fifth chunk fails twice before succeeding
+		if index%5 == 0 && attempts[index] <= 2 {
+			return fmt.Errorf("connection reset")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	if peak.Load() > 4 {
+		t.Errorf("Expected at most 4 requests in flight, saw %d", peak.Load())
+	}
+	if peak.Load() < 2 {
+		t.Errorf("Expected requests to overlap, saw %d in flight", peak.Load())
+	}
+	for i := range metadata.ChunkHashes {
+		want := 1
+		if i%5 == 0 {
+			want = 3
+		}
+		if attempts[i] != want {
+			t.Errorf("Chunk %d requested %d times, expected %d", i, attempts[i], want)
+		}
+	}
+
+	if len(reports) != 40 {
+		t.Fatalf("Expected 40 progress reports, got %d", len(reports))
+	}
+	var total int64
+	for _, size := range metadata.ChunkSizes {
+		total += size
+	}
+	last := reports[len(reports)-1]
+	if last.ChunksDone != 40 || last.ChunksTotal != 40 || last.BytesDone != total || last.BytesTotal != total {
+		t.Errorf("Unexpected final progress: %+v", last)
+	}
+	inOrder := true
+	for i, p := range reports {
+		if p.ChunksDone != i+1 {
+			t.Errorf("Report %d has %d chunks done", i, p.ChunksDone)
+		}
+		inOrder = inOrder && p.Chunk == i
+	}
+	if inOrder {
+		t.Error("Expected chunks to complete out of order")
+	}
+}
+
+func TestDownloadChunksFailure(t *testing.T) {
+	metadata := testDownloadMetadata(20)
+
+	// A missing chunk is not retried and stops the download
+	var calls atomic.Int32
+	var missingAttempts atomic.Int32
+	err := downloadChunks(metadata, DownloadOptions{Concurrency: 2, Backoff: time.Millisecond}, func(index int) error {
+		calls.Add(1)
+		if index == 3 {
+			missingAttempts.Add(1)
+			return &PeerError{Peer: "peer", Code: CodeNotFound, Message: "chunk not found"}
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrChunkNotFound) {
+		t.Fatalf("Expected chunk not found, got %v", err)
+	}
+	if missingAttempts.Load() != 1 {
+		t.Errorf("Missing chunk requested %d times", missingAttempts.Load())
+	}
+	if calls.Load() >= 20 {
+		t.Errorf("Download kept going after a failure: %d requests", calls.Load())
+	}
+
+	// A transient error is retried until the retries run out
+	var busyAttempts atomic.Int32
+	err = downloadChunks(metadata, DownloadOptions{Retries: 2, Backoff: time.Millisecond}, func(index int) error {
+		if index == 7 {
+			busyAttempts.Add(1)
+			return &PeerError{Peer: "peer", Code: CodeBusy, Message: "too many connections"}
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrBusy) {
+		t.Fatalf("Expected busy, got %v", err)
+	}
+	if busyAttempts.Load() != 3 {
+		t.Errorf("Busy chunk requested %d times, expected 3", busyAttempts.Load())
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// GCOptions controls a garbage collection run
+type GCOptions struct {
+	// DryRun only reports what would be reclaimed
+	DryRun bool
+	// GracePeriod moves orphaned chunks to quarantine instead of deleting
+	// them, and only purges quarantined chunks older than this
+	GracePeriod time.Duration
+}
+
+// GCReport summarises a garbage collection run
+type GCReport struct {
+	DryRun     bool `json:"dryRun"`
+	LiveChunks int  `json:"liveChunks"`
+	// Orphaned lists chunks in the store that no metadata references
+	Orphaned         []ChunkInfo `json:"orphaned"`
+	ReclaimableBytes int64       `json:"reclaimableBytes"`
+
+	Deleted     int `json:"deleted"`
+	Quarantined int `json:"quarantined"`
+	Restored    int `json:"restored"`
+	Purged      int `json:"purged"`
+	// ReclaimedBytes counts bytes actually freed by deletes and purges
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+}
+
+// CollectGarbage walks all metadata to find the live chunk set and removes
+// every stored chunk outside it. Quarantined chunks that became live again
+// are restored, and those past the grace period are purged.
+func (se *StorageEngine) CollectGarbage(opts GCOptions) (*GCReport, error) {
+	se.gcMu.Lock()
+	defer se.gcMu.Unlock()
+
+	// Mark
+	live, err := se.liveChunks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute live chunks: %v", err)
+	}
+
+	// Sweep
+	stored, err := se.chunks.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %v", err)
+	}
+
+	report := &GCReport{DryRun: opts.DryRun, LiveChunks: len(live)}
+	for _, hash := range stored {
+		if live[hash] {
+			continue
+		}
+		info, err := se.chunks.Stat(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat chunk %s: %v", hash, err)
+		}
+		report.Orphaned = append(report.Orphaned, info)
+		report.ReclaimableBytes += info.Size
+	}
+
+	if err := se.sweepQuarantine(live, opts, report); err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for _, info := range report.Orphaned {
+		if opts.GracePeriod > 0 {
+			if err := se.quarantineChunk(info.Hash); err != nil {
+				return report, err
+			}
+			report.Quarantined++
+			continue
+		}
+		if err := se.chunks.Delete(info.Hash); err != nil {
+			return report, fmt.Errorf("failed to delete chunk %s: %v", info.Hash, err)
+		}
+		report.Deleted++
+		report.ReclaimedBytes += info.Size
+	}
+
+	// Resynchronise reference counts with the metadata just walked
+	se.refMu.Lock()
+	defer se.refMu.Unlock()
+	if _, err := se.rebuildRefs(); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// liveChunks returns the set of chunk hashes referenced by any file version
+func (se *StorageEngine) liveChunks() (map[string]bool, error) {
+	all, err := se.allVersionDocs()
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]bool)
+	for _, metadata := range all {
+		for _, hash := range metadata.ChunkHashes {
+			live[hash] = true
+		}
+	}
+	return live, nil
+}
+
+func (se *StorageEngine) quarantinePath() string {
+	return filepath.Join(se.statePath, "quarantine")
+}
+
+// quarantineChunk moves a chunk out of the chunk store into the quarantine
+// directory, where its modification time records when it was quarantined
+func (se *StorageEngine) quarantineChunk(hash string) error {
+	return se.moveToQuarantine(hash, se.quarantinePath())
+}
+
+// quarantineCorruptChunk moves a chunk that failed verification aside.
+// Corrupt chunks are kept in a subdirectory that GC never restores or
+// purges, so they stay available for inspection.
+func (se *StorageEngine) quarantineCorruptChunk(hash string) error {
+	return se.moveToQuarantine(hash, filepath.Join(se.quarantinePath(), "corrupt"))
+}
+
+func (se *StorageEngine) moveToQuarantine(hash, dir string) error {
+	data, err := se.chunks.Get(hash)
+	if err != nil {
+		return &ChunkError{Hash: hash, Err: err}
+	}
+
+	if err := os.MkdirAll(dir, se.dirPerm); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, hash), data, se.filePerm); err != nil {
+		return fmt.Errorf("failed to quarantine chunk %s: %v", hash, err)
+	}
+	if err := se.chunks.Delete(hash); err != nil {
+		return fmt.Errorf("failed to remove quarantined chunk %s: %v", hash, err)
+	}
+	return nil
+}
+
+// sweepQuarantine restores quarantined chunks that are referenced again and
+// purges those whose grace period has expired
+func (se *StorageEngine) sweepQuarantine(live map[string]bool, opts GCOptions, report *GCReport) error {
+	entries, err := os.ReadDir(se.quarantinePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list quarantine: %v", err)
+	}
+
+	for _, entry := range entries {
+		hash := entry.Name()
+		if entry.IsDir() || validateHash(hash) != nil {
+			continue
+		}
+		path := filepath.Join(se.quarantinePath(), hash)
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat quarantined chunk %s: %v", hash, err)
+		}
+
+		if live[hash] {
+			if opts.DryRun {
+				continue
+			}
+			if err := se.restoreChunk(hash, path); err != nil {
+				return err
+			}
+			report.Restored++
+			continue
+		}
+
+		if time.Since(info.ModTime()) < opts.GracePeriod {
+			continue
+		}
+		if opts.DryRun {
+			report.ReclaimableBytes += info.Size()
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to purge quarantined chunk %s: %v", hash, err)
+		}
+		report.Purged++
+		report.ReclaimedBytes += info.Size()
+	}
+	return nil
+}
+
+// restoreChunk moves a verified quarantined chunk back into the chunk store
+func (se *StorageEngine) restoreChunk(hash, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read quarantined chunk %s: %v", hash, err)
+	}
+
+	if _, err := decodeStoredChunk(hash, data); err != nil {
+		return err
+	}
+	if err := se.chunks.Put(hash, data); err != nil {
+		return &ChunkError{Hash: hash, Err: err}
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	engine := newTestEngine(t)
+
+	kept := bytes.Repeat([]byte("k"), 3000)
+	dropped := bytes.Repeat([]byte("d"), 3000)
+	if _, err := engine.Ingest(bytes.NewReader(kept), "kept.txt", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if _, err := engine.Ingest(bytes.NewReader(dropped), "dropped.txt", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	// Drop the metadata without releasing references, leaving orphans
+	err := engine.meta.update(func(tx *bolt.Tx) error {
+		_, err := removeFile(tx, "dropped.txt")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to remove metadata: %v", err)
+	}
+
+	report, err := engine.CollectGarbage(GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	// "ddd..." splits into two distinct chunks: 1024 repeated bytes and the 952 byte tail
+	if len(report.Orphaned) != 2 || report.ReclaimableBytes != 1024+952 {
+		t.Errorf("Unexpected dry run report: %+v", report)
+	}
+	if hashes, _ := engine.chunks.List(); len(hashes) != 4 {
+		t.Errorf("Dry run removed chunks, %d left", len(hashes))
+	}
+
+	report, err = engine.CollectGarbage(GCOptions{})
+	if err != nil {
+		t.Fatalf("Garbage collection failed: %v", err)
+	}
+	if report.Deleted != 2 || report.ReclaimedBytes != 1024+952 {
+		t.Errorf("Unexpected GC report: %+v", report)
+	}
+
+	metadata, err := engine.readMetadata("kept.txt")
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	if err := engine.ReassembleFile(metadata, filepath.Join(t.TempDir(), "kept.txt")); err != nil {
+		t.Errorf("Live file damaged by GC: %v", err)
+	}
+}
+
+func TestCollectGarbageGracePeriod(t *testing.T) {
+	engine := newTestEngine(t)
+
+	data := []byte("briefly orphaned")
+	metadata, err := engine.Ingest(bytes.NewReader(data), "orphan.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	var saved []*FileMetadata
+	engine.meta.update(func(tx *bolt.Tx) error {
+		saved, err = removeFile(tx, "orphan.txt")
+		return err
+	})
+	if len(saved) != 1 {
+		t.Fatalf("Failed to remove metadata: %v", err)
+	}
+
+	report, err := engine.CollectGarbage(GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("Garbage collection failed: %v", err)
+	}
+	if report.Quarantined != 1 || report.Deleted != 0 {
+		t.Errorf("Expected chunk to be quarantined: %+v", report)
+	}
+	if has, _ := engine.chunks.Has(metadata.ChunkHashes[0]); has {
+		t.Error("Quarantined chunk still in store")
+	}
+
+	// Referencing the chunk again restores it from quarantine
+	engine.meta.update(func(tx *bolt.Tx) error {
+		if err := putVersion(tx, saved[0]); err != nil {
+			return err
+		}
+		return putFile(tx, saved[0])
+	})
+	report, err = engine.CollectGarbage(GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("Garbage collection failed: %v", err)
+	}
+	if report.Restored != 1 {
+		t.Errorf("Expected chunk to be restored: %+v", report)
+	}
+	if _, err := engine.readChunk(metadata.ChunkHashes[0]); err != nil {
+		t.Errorf("Restored chunk unreadable: %v", err)
+	}
+}
+
+func TestDeleteFileKeepsSharedChunks(t *testing.T) {
+	engine := newTestEngine(t)
+
+	shared := bytes.Repeat([]byte("s"), 1024)
+	unique := bytes.Repeat([]byte("u"), 1024)
+	if _, err := engine.Ingest(bytes.NewReader(append(shared, unique...)), "a.txt", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	other, err := engine.Ingest(bytes.NewReader(shared), "b.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	result, err := engine.DeleteFile("a.txt")
+	if err != nil {
+		t.Fatalf("Failed to delete file: %v", err)
+	}
+	if result.ReleasedChunks != 1 || result.ReleasedBytes != 1024 {
+		t.Errorf("Expected only the unique chunk to be released: %+v", result)
+	}
+	if _, err := engine.readMetadata("a.txt"); err == nil {
+		t.Error("Metadata still present after delete")
+	}
+	if err := engine.ReassembleFile(other, filepath.Join(t.TempDir(), "b.txt")); err != nil {
+		t.Errorf("Shared chunk released with a remaining reference: %v", err)
+	}
+
+	if _, err := engine.DeleteFile("b.txt"); err != nil {
+		t.Fatalf("Failed to delete file: %v", err)
+	}
+	if hashes, _ := engine.chunks.List(); len(hashes) != 0 {
+		t.Errorf("Expected all chunks released, %d left", len(hashes))
+	}
+}
@@ -5,7 +5,7 @@ go 1.22.1
 require google.golang.org/grpc v1.69.0
 
 require (
-	github.com/boltdb/bolt v1.3.1
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/net v0.30.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// FileList is one page of a ListFiles listing
+type FileList struct {
+	Files []*FileMetadata `json:"files"`
+	// Next is passed as after to fetch the following page; it is empty
+	// on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// ListFiles returns the current metadata of files whose paths start with
+// prefix, in path order. Only paths after the cursor are returned, at most
+// limit of them; a limit of zero or less returns everything.
+func (se *StorageEngine) ListFiles(prefix, after string, limit int) (*FileList, error) {
+	list := &FileList{}
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		start := prefix
+		if after > start {
+			start = after
+		}
+		c := tx.Bucket(filesBucket).Cursor()
+		k, v := c.Seek([]byte(start))
+		if k != nil && after != "" && string(k) == after {
+			k, v = c.Next()
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if limit > 0 && len(list.Files) == limit {
+				list.Next = list.Files[len(list.Files)-1].FileName
+				break
+			}
+			metadata, err := decodeMetadata(v)
+			if err != nil {
+				return fmt.Errorf("failed to load %s: %v", k, err)
+			}
+			metadata.FileName = string(k)
+			list.Files = append(list.Files, metadata)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+	return list, nil
+}
+
+// CountFiles counts the files whose paths start with prefix
+func (se *StorageEngine) CountFiles(prefix string) (int, error) {
+	count := 0
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		return scanPrefix(tx.Bucket(filesBucket), []byte(prefix), func(_, _ []byte) (bool, error) {
+			count++
+			return true, nil
+		})
+	})
+	return count, err
+}
+
+// FilesWithChunk returns the paths of files with a current or older
+// version referencing the chunk, sorted by path
+func (se *StorageEngine) FilesWithChunk(hash string) ([]string, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		prefix := joinKey([]byte(hash), nil)
+		return scanPrefix(tx.Bucket(chunkFilesBucket), prefix, func(k, _ []byte) (bool, error) {
+			names = append(names, string(k[len(prefix):]))
+			return true, nil
+		})
+	})
+	return names, err
+}
+
+// FileByRoot returns a version of a file with the given Merkle root,
+// preferring a current version. A non-empty fileName restricts the search
+// to that file's history.
+func (se *StorageEngine) FileByRoot(root, fileName string) (*FileMetadata, error) {
+	if err := validateHash(root); err != nil {
+		return nil, fmt.Errorf("invalid merkle root %q: %w", root, ErrInvalidHash)
+	}
+	prefix := joinKey([]byte(root), nil)
+	if fileName != "" {
+		if err := validateFileName(fileName); err != nil {
+			return nil, err
+		}
+		prefix = joinKey([]byte(root), []byte(fileName), nil)
+	}
+
+	var found *FileMetadata
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		return scanPrefix(tx.Bucket(rootsBucket), prefix, func(k, _ []byte) (bool, error) {
+			name, version := splitVersionKey(k[len(root)+1:])
+			if current, err := getFile(tx, name); err == nil && current.Version == version {
+				found = current
+				return false, nil
+			}
+			if found == nil {
+				metadata, err := getVersion(tx, name, version)
+				if err != nil {
+					return false, err
+				}
+				found = metadata
+			}
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up merkle root %s: %v", root, err)
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no file with merkle root %s: %w", root, os.ErrNotExist)
+	}
+	return found, nil
+}
+
+// FindFiles returns the current metadata of every file matching query,
+// sorted by path. Label and size conditions are answered from their
+// indexes; the remaining conditions filter the candidates.
+func (se *StorageEngine) FindFiles(query FileQuery) ([]*FileMetadata, error) {
+	if err := validateDirPath(query.Prefix); err != nil {
+		return nil, err
+	}
+
+	var matches []*FileMetadata
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		names, indexed := queryCandidates(tx, query)
+		if !indexed {
+			prefix := ""
+			if query.Prefix != "" {
+				prefix = query.Prefix + "/"
+			}
+			return scanPrefix(tx.Bucket(filesBucket), []byte(prefix), func(k, v []byte) (bool, error) {
+				metadata, err := decodeMetadata(v)
+				if err != nil {
+					return false, fmt.Errorf("failed to load %s: %v", k, err)
+				}
+				metadata.FileName = string(k)
+				if query.Matches(metadata) {
+					matches = append(matches, metadata)
+				}
+				return true, nil
+			})
+		}
+
+		for _, name := range names {
+			metadata, err := getFile(tx, name)
+			if err != nil {
+				return err
+			}
+			if query.Matches(metadata) {
+				matches = append(matches, metadata)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find files: %v", err)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].FileName < matches[j].FileName
+	})
+	return matches, nil
+}
+
+// queryCandidates narrows a query down to candidate paths using the label
+// index, preferring a label with a value, or else the size index. It
+// reports false when neither applies.
+func queryCandidates(tx *bolt.Tx, query FileQuery) ([]string, bool) {
+	if len(query.Labels) > 0 {
+		keys := make([]string, 0, len(query.Labels))
+		for key := range query.Labels {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if (query.Labels[keys[i]] != "") != (query.Labels[keys[j]] != "") {
+				return query.Labels[keys[i]] != ""
+			}
+			return keys[i] < keys[j]
+		})
+		return labelCandidates(tx, keys[0], query.Labels[keys[0]]), true
+	}
+
+	if query.MinSize > 0 || query.MaxSize > 0 {
+		var names []string
+		c := tx.Bucket(sizesBucket).Cursor()
+		for k, _ := c.Seek(sizeKey(query.MinSize, "")); k != nil; k, _ = c.Next() {
+			if query.MaxSize > 0 && int64(binary.BigEndian.Uint64(k[:8])) > query.MaxSize {
+				break
+			}
+			names = append(names, string(k[8:]))
+		}
+		return names, true
+	}
+	return nil, false
+}
+
+// labelCandidates returns the paths carrying a label, with the given value
+// unless it is empty
+func labelCandidates(tx *bolt.Tx, key, value string) []string {
+	prefix := joinKey([]byte(key), nil)
+	if value != "" {
+		prefix = joinKey([]byte(key), []byte(value), nil)
+	}
+
+	var names []string
+	scanPrefix(tx.Bucket(labelsBucket), prefix, func(k, _ []byte) (bool, error) {
+		rest := k[len(prefix):]
+		if value == "" {
+			// Skip the value to reach the path
+			rest = rest[bytes.IndexByte(rest, 0)+1:]
+		}
+		names = append(names, string(rest))
+		return true, nil
+	})
+	return names
+}
@@ -5,16 +5,24 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
 	ChunkSize   = 1024 * 1024 // 1MB chunks
 	StorageDir  = "./storage"
 	MetadataDir = "./metadata"
+	StateDir    = "./state"
 )
 
 // FileMetadata stores information about a split file
@@ -23,34 +31,327 @@ type FileMetadata struct {
 	TotalSize   int64    `json:"totalSize"`
 	ChunkHashes []string `json:"chunkHashes"`
 	ChunkSizes  []int64  `json:"chunkSizes"`
+	// Chunking records how the file was split; nil means fixed ChunkSize
+	Chunking *ChunkingParams `json:"chunking,omitempty"`
+	// ChunkCodecs records the codec each chunk is stored with; nil means
+	// every chunk is uncompressed
+	ChunkCodecs []string `json:"chunkCodecs,omitempty"`
+	// Encryption is set when the chunks are encrypted
+	Encryption *EncryptionInfo `json:"encryption,omitempty"`
+
+	// Version history: each ingest of a name stores a new version
+	Version   int       `json:"version,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Author    string    `json:"author,omitempty"`
+	// FileHash is the hex SHA-256 of the whole file contents
+	FileHash string `json:"fileHash,omitempty"`
+	// MerkleRoot is the root of the Merkle tree over ChunkHashes
+	MerkleRoot string `json:"merkleRoot,omitempty"`
+	// Attributes holds the file's mode, times, owner, type and labels
+	Attributes *FileAttributes `json:"attributes,omitempty"`
+
+	// Stats is filled in by Ingest and SplitFile and is not persisted
+	Stats *IngestStats `json:"-"`
+}
+
+// IngestStats reports how much of an ingested file was new to the store
+type IngestStats struct {
+	NewChunks   int   `json:"newChunks"`
+	NewBytes    int64 `json:"newBytes"`
+	DedupChunks int   `json:"dedupChunks"`
+	DedupBytes  int64 `json:"dedupBytes"`
 }
 
 // StorageEngine handles local file operations
 type StorageEngine struct {
-	basePath     string
+	chunks       ChunkStore
 	metadataPath string
+	statePath    string
+	nodeID       string
+	meta         *metadataDB
+	chunking     ChunkingParams
+	compression  string
+	encryption   string
+	keyring      Keyring
+	filePerm     os.FileMode
+	dirPerm      os.FileMode
+
+	// gcMu is held for reading while files are ingested or downloaded and
+	// for writing while garbage is collected, so GC never sees half-written
+	// files
+	gcMu sync.RWMutex
+
+	// refs caches the chunk reference counts and pins counts chunks held
+	// by ingests in progress, both guarded by refMu
+	refs  refCounts
+	pins  map[string]int
+	refMu sync.Mutex
+}
+
+var (
+	// ErrChunkNotFound is returned when a chunk is not present in storage
+	ErrChunkNotFound = errors.New("chunk not found")
+	// ErrChunkCorrupt is returned when chunk contents don't match their hash
+	ErrChunkCorrupt = errors.New("chunk corrupt")
+	// ErrInvalidHash is returned for strings that are not hex SHA-256 digests
+	ErrInvalidHash = errors.New("invalid chunk hash")
+	// ErrInvalidName is returned for logical paths that cannot be stored
+	ErrInvalidName = errors.New("invalid file name")
+)
+
+// ChunkError describes a failed chunk operation. Err is ErrChunkNotFound,
+// ErrChunkCorrupt, ErrInvalidHash or the underlying I/O error.
+type ChunkError struct {
+	Hash string
+	Err  error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %s: %v", e.Hash, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// validateHash checks that hash is a lowercase hex SHA-256 digest, which
+// also keeps peer supplied hashes from escaping the storage directory
+func validateHash(hash string) error {
+	if len(hash) != sha256.Size*2 || strings.ToLower(hash) != hash {
+		return &ChunkError{Hash: hash, Err: ErrInvalidHash}
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return &ChunkError{Hash: hash, Err: ErrInvalidHash}
+	}
+	return nil
+}
+
+// chunkHash returns the hex SHA-256 of data
+func chunkHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// storedChunk is a verified chunk together with the encoding it is stored in
+type storedChunk struct {
+	Data    []byte // uncompressed contents
+	Codec   string
+	Payload []byte // stored bytes without the chunk header
+}
+
+// readChunk loads a chunk from the chunk store and verifies it against its hash
+func (se *StorageEngine) readChunk(hash string) ([]byte, error) {
+	chunk, err := se.readStoredChunk(hash)
+	if err != nil {
+		return nil, err
+	}
+	return chunk.Data, nil
 }
 
-func (se *StorageEngine) readChunk(hash string) (any, any) {
-	panic("unimplemented")
+// readStoredChunk loads and verifies a chunk, keeping its stored encoding
+func (se *StorageEngine) readStoredChunk(hash string) (*storedChunk, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+
+	stored, err := se.chunks.Get(hash)
+	if err != nil {
+		return nil, &ChunkError{Hash: hash, Err: err}
+	}
+	return decodeStoredChunk(hash, stored)
+}
+
+// decodeStoredChunk decompresses stored chunk bytes and verifies the result
+func decodeStoredChunk(hash string, stored []byte) (*storedChunk, error) {
+	codec, payload := unwrapChunk(stored)
+	if codec != CodecNone {
+		data, err := decodePayload(codec, payload)
+		if err == nil && chunkHash(data) == hash {
+			return &storedChunk{Data: data, Codec: codec, Payload: payload}, nil
+		}
+	}
+
+	// Uncompressed, or raw data that merely starts like a chunk header
+	if chunkHash(stored) != hash {
+		return nil, &ChunkError{Hash: hash, Err: ErrChunkCorrupt}
+	}
+	return &storedChunk{Data: stored, Codec: CodecNone, Payload: stored}, nil
+}
+
+// fileChunks reads the chunks of one file as plaintext
+type fileChunks struct {
+	storage  *StorageEngine
+	metadata *FileMetadata
+	sealer   *chunkSealer
+}
+
+// fileChunks prepares reading the chunks of a file, loading its keys when
+// the file is encrypted
+func (se *StorageEngine) fileChunks(metadata *FileMetadata) (*fileChunks, error) {
+	fc := &fileChunks{storage: se, metadata: metadata}
+	if metadata.Encryption != nil && metadata.Encryption.Mode != EncryptionNone {
+		sealer, err := se.openChunkSealer(metadata.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		fc.sealer = sealer
+	}
+	return fc, nil
+}
+
+// read loads and verifies the chunk at index, decrypts it if needed and
+// checks it has the size recorded in metadata
+func (fc *fileChunks) read(index int) ([]byte, error) {
+	hash := fc.metadata.ChunkHashes[index]
+	data, err := fc.storage.readChunk(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if fc.sealer != nil {
+		inner, err := fc.sealer.open(data, index)
+		if err != nil {
+			return nil, &ChunkError{Hash: hash, Err: fmt.Errorf("%w: decryption failed: %v", ErrChunkCorrupt, err)}
+		}
+		// Encrypted chunks are compressed inside the ciphertext
+		data = inner
+		if index < len(fc.metadata.ChunkCodecs) && fc.metadata.ChunkCodecs[index] != CodecNone {
+			_, payload := unwrapChunk(inner)
+			data, err = decodePayload(fc.metadata.ChunkCodecs[index], payload)
+			if err != nil {
+				return nil, &ChunkError{Hash: hash, Err: fmt.Errorf("%w: %v", ErrChunkCorrupt, err)}
+			}
+		}
+	}
+
+	size := fc.metadata.ChunkSizes[index]
+	if int64(len(data)) != size {
+		return nil, &ChunkError{
+			Hash: hash,
+			Err:  fmt.Errorf("%w: size %d, expected %d", ErrChunkCorrupt, len(data), size),
+		}
+	}
+	return data, nil
 }
 
 // NewStorageEngine creates a new storage engine instance
 func NewStorageEngine() (*StorageEngine, error) {
-	// Create storage directories if they don't exist
-	for _, dir := range []string{StorageDir, MetadataDir} {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
+	return NewStorageEngineWithOptions(StorageOptions{})
+}
+
+// NewStorageEngineWithStore creates a storage engine keeping chunks in store
+func NewStorageEngineWithStore(store ChunkStore) (*StorageEngine, error) {
+	return NewStorageEngineWithOptions(StorageOptions{ChunkStore: store})
+}
+
+// NewStorageEngineWithOptions creates a storage engine with its own
+// directories, chunking and permissions
+func NewStorageEngineWithOptions(opts StorageOptions) (*StorageEngine, error) {
+	opts = opts.withDefaults()
+	if err := opts.Chunking.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid chunking parameters: %v", err)
+	}
+	if err := validateCodec(opts.Compression); err != nil {
+		return nil, fmt.Errorf("invalid compression: %v", err)
+	}
+	if err := validateEncryption(opts.Encryption); err != nil {
+		return nil, fmt.Errorf("invalid encryption: %v", err)
+	}
+
+	// Create metadata directory if it doesn't exist
+	if err := os.MkdirAll(opts.MetadataDir, opts.DirPerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", opts.MetadataDir, err)
+	}
+
+	meta, err := openMetadataDB(filepath.Join(opts.MetadataDir, metadataDBName), opts.FilePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	store := opts.ChunkStore
+	if store == nil {
+		fsStore, err := newFSChunkStore(opts.StorageDir, opts.FilePerm, opts.DirPerm)
+		if err != nil {
+			meta.close()
+			return nil, err
+		}
+		store = fsStore
+	}
+
+	se := &StorageEngine{
+		chunks:       store,
+		metadataPath: opts.MetadataDir,
+		statePath:    opts.StateDir,
+		nodeID:       opts.NodeID,
+		meta:         meta,
+		chunking:     opts.Chunking,
+		compression:  opts.Compression,
+		encryption:   opts.Encryption,
+		keyring:      opts.Keyring,
+		filePerm:     opts.FilePerm,
+		dirPerm:      opts.DirPerm,
+	}
+
+	// Clean up after any interrupted writes from a previous run
+	report, err := se.Recover(opts.VerifyOnStartup)
+	if err != nil {
+		meta.close()
+		return nil, fmt.Errorf("startup recovery failed: %v", err)
+	}
+	if report.TempFilesRemoved > 0 || len(report.CorruptChunks) > 0 {
+		fmt.Printf("Recovery removed %d temporary files and quarantined %d corrupt chunks\n",
+			report.TempFilesRemoved, len(report.CorruptChunks))
+	}
+
+	// Metadata used to be one JSON document per file
+	migrated, err := se.migrateJSONMetadata()
+	if err != nil {
+		meta.close()
+		return nil, fmt.Errorf("metadata migration failed: %v", err)
+	}
+	if migrated > 0 {
+		fmt.Printf("Migrated metadata of %d files into %s\n", migrated, metadataDBName)
+	}
+
+	return se, nil
+}
+
+// Close releases the metadata database and the chunk store if it holds
+// resources
+func (se *StorageEngine) Close() error {
+	err := se.meta.close()
+	if closer, ok := se.chunks.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
 		}
 	}
+	return err
+}
 
-	return &StorageEngine{
-		basePath:     StorageDir,
-		metadataPath: MetadataDir,
-	}, nil
+// SetChunking selects the chunking algorithm used by SplitFile
+func (se *StorageEngine) SetChunking(params ChunkingParams) error {
+	if err := params.Validate(); err != nil {
+		return fmt.Errorf("invalid chunking parameters: %v", err)
+	}
+	se.chunking = params
+	return nil
+}
+
+// IngestOptions carries optional expectations about an ingested stream
+type IngestOptions struct {
+	// ExpectedSize is the stream length in bytes; zero skips the check
+	ExpectedSize int64
+	// ExpectedHash is the hex SHA-256 of the whole stream; empty skips the check
+	ExpectedHash string
+	// Encryption overrides the engine's encryption mode for this file
+	Encryption string
+	// Attributes are recorded in the metadata; a missing MIME type is
+	// detected from the name and contents
+	Attributes *FileAttributes
 }
 
-// SplitFile splits a file into chunks and generates hashes
+// SplitFile splits a file into chunks and generates hashes. The file is
+// stored under LogicalPath(filePath).
 func (se *StorageEngine) SplitFile(filePath string) (*FileMetadata, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -63,84 +364,260 @@ func (se *StorageEngine) SplitFile(filePath string) (*FileMetadata, error) {
 		return nil, fmt.Errorf("failed to get file info: %v", err)
 	}
 
+	return se.Ingest(file, LogicalPath(filePath), IngestOptions{
+		ExpectedSize: fileInfo.Size(),
+		Attributes:   fileAttributes(filePath, fileInfo),
+	})
+}
+
+// Ingest splits the data read from r into chunks and stores it under the
+// logical name. Metadata is only stored once the whole stream has been
+// read and matches the expectations in opts.
+func (se *StorageEngine) Ingest(r io.Reader, name string, opts IngestOptions) (*FileMetadata, error) {
+	if err := validateFileName(name); err != nil {
+		return nil, err
+	}
+	// Fail before storing any chunks; commitMetadata checks again
+	if err := se.checkFilePath(name); err != nil {
+		return nil, err
+	}
+	if opts.Attributes != nil {
+		if err := validateLabels(opts.Attributes.Labels); err != nil {
+			return nil, err
+		}
+	}
+
+	se.gcMu.RLock()
+	defer se.gcMu.RUnlock()
+
+	chunking := se.chunking
 	metadata := &FileMetadata{
-		FileName:    filepath.Base(filePath),
-		TotalSize:   fileInfo.Size(),
+		FileName:    name,
 		ChunkHashes: make([]string, 0),
 		ChunkSizes:  make([]int64, 0),
+		Chunking:    &chunking,
+		CreatedAt:   time.Now().UTC(),
+		Author:      se.nodeID,
+		Attributes:  opts.Attributes.clone(),
+		Stats:       &IngestStats{},
+	}
+
+	// Chunks this ingest wrote are deleted again unless it commits
+	var written []string
+	committed := false
+	defer func() {
+		se.unpinChunks(metadata.ChunkHashes)
+		if !committed {
+			se.discardChunks(written)
+		}
+	}()
+
+	mode := opts.Encryption
+	if mode == "" {
+		mode = se.encryption
+	}
+	if err := validateEncryption(mode); err != nil {
+		return nil, err
+	}
+	var sealer *chunkSealer
+	if mode != EncryptionNone {
+		var err error
+		if sealer, err = se.newChunkSealer(mode); err != nil {
+			return nil, err
+		}
+		metadata.Encryption = sealer.info
+	}
+
+	var codecs []string
+	fileHash := sha256.New()
+	head := &prefixBuffer{limit: sniffLen}
+	chunker, err := NewChunker(io.TeeReader(r, io.MultiWriter(fileHash, head)), chunking)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chunker: %v", err)
 	}
 
-	buffer := make([]byte, ChunkSize)
 	for {
-		n, err := file.Read(buffer)
-		if n == 0 || err == io.EOF {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("error reading file: %v", err)
+			return nil, fmt.Errorf("error reading input: %v", err)
 		}
 
 		// Generate hash for chunk
-		hash := sha256.Sum256(buffer[:n])
-		hashString := hex.EncodeToString(hash[:])
+		hashString := chunkHash(chunk)
+
+		// Encrypted chunks are compressed first, since ciphertext doesn't
+		// compress, and addressed by the hash of the ciphertext
+		var sealed []byte
+		codec := CodecNone
+		if sealer != nil {
+			var inner []byte
+			if inner, codec, err = encodeChunk(se.compression, chunk); err != nil {
+				return nil, err
+			}
+			if sealed, err = sealer.seal(inner); err != nil {
+				return nil, fmt.Errorf("failed to encrypt chunk: %v", err)
+			}
+			hashString = chunkHash(sealed)
+		}
+
+		se.pinChunk(hashString)
 		metadata.ChunkHashes = append(metadata.ChunkHashes, hashString)
-		metadata.ChunkSizes = append(metadata.ChunkSizes, int64(n))
+		metadata.ChunkSizes = append(metadata.ChunkSizes, int64(len(chunk)))
+		metadata.TotalSize += int64(len(chunk))
 
-		// Store chunk
-		if err := se.storeChunk(hashString, buffer[:n]); err != nil {
+		// Store chunk unless the content is already present
+		exists, err := se.chunks.Has(hashString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check chunk: %v", &ChunkError{Hash: hashString, Err: err})
+		}
+		if exists {
+			storedCodec, err := se.chunkCodec(hashString)
+			switch {
+			case errors.Is(err, ErrChunkCorrupt):
+				// The stream holds a good copy, so replace the bad one
+				if err := se.quarantineCorruptChunk(hashString); err != nil && !errors.Is(err, ErrChunkNotFound) {
+					return nil, err
+				}
+				exists = false
+			case err != nil:
+				return nil, fmt.Errorf("failed to read existing chunk: %w", err)
+			case sealer == nil:
+				codec = storedCodec
+			}
+		}
+		if exists {
+			codecs = append(codecs, codec)
+			metadata.Stats.DedupChunks++
+			metadata.Stats.DedupBytes += int64(len(chunk))
+			continue
+		}
+		if sealer != nil {
+			err = se.storeCompressedChunk(hashString, CodecNone, sealed)
+		} else {
+			codec, err = se.storeChunk(hashString, chunk)
+		}
+		if err != nil {
 			return nil, fmt.Errorf("failed to store chunk: %v", err)
 		}
+		written = append(written, hashString)
+		codecs = append(codecs, codec)
+		metadata.Stats.NewChunks++
+		metadata.Stats.NewBytes += int64(len(chunk))
+	}
+
+	// Only record codecs when at least one chunk is compressed
+	for _, codec := range codecs {
+		if codec != CodecNone {
+			metadata.ChunkCodecs = codecs
+			break
+		}
+	}
+
+	if opts.ExpectedSize > 0 && metadata.TotalSize != opts.ExpectedSize {
+		return nil, fmt.Errorf("size mismatch for %s: expected %d bytes, read %d", name, opts.ExpectedSize, metadata.TotalSize)
+	}
+	metadata.FileHash = hex.EncodeToString(fileHash.Sum(nil))
+	if metadata.Attributes.MIMEType == "" {
+		metadata.Attributes.MIMEType = detectMIMEType(name, head.buf)
+	}
+	if metadata.MerkleRoot, err = MerkleRoot(metadata.ChunkHashes); err != nil {
+		return nil, fmt.Errorf("failed to compute merkle root: %v", err)
+	}
+	if opts.ExpectedHash != "" && !strings.EqualFold(metadata.FileHash, opts.ExpectedHash) {
+		return nil, fmt.Errorf("hash mismatch for %s: expected %s, got %s", name, opts.ExpectedHash, metadata.FileHash)
 	}
 
-	// Store metadata
-	if err := se.storeMetadata(metadata); err != nil {
-		return nil, fmt.Errorf("failed to store metadata: %v", err)
+	// Store metadata and take references on its chunks
+	if err := se.commitMetadata(metadata); err != nil {
+		return nil, err
 	}
+	committed = true
 
 	return metadata, nil
 }
 
-// storeChunk saves a single chunk to disk
-func (se *StorageEngine) storeChunk(hash string, data []byte) error {
-	chunkPath := filepath.Join(se.basePath, hash)
-	return os.WriteFile(chunkPath, data, 0644)
+// validateFileName rejects logical paths that are not clean, relative and
+// slash separated
+func validateFileName(name string) error {
+	if name == "" || name == "." || path.Clean(name) != name || path.IsAbs(name) ||
+		name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, `\`) {
+		return fmt.Errorf("%w %q", ErrInvalidName, name)
+	}
+	// Zero bytes separate fields in metadata index keys
+	if strings.ContainsRune(name, 0) {
+		return fmt.Errorf("%w %q", ErrInvalidName, name)
+	}
+	return nil
 }
 
-// storeMetadata saves file metadata to disk
-func (se *StorageEngine) storeMetadata(metadata *FileMetadata) error {
-	data, err := json.Marshal(metadata)
+// storeChunk compresses a chunk with the engine's codec and saves it to
+// the chunk store, returning the codec actually used
+func (se *StorageEngine) storeChunk(hash string, data []byte) (string, error) {
+	if err := validateHash(hash); err != nil {
+		return "", err
+	}
+	stored, codec, err := encodeChunk(se.compression, data)
 	if err != nil {
-		return fmt.Errorf("failed to marshal metadata: %v", err)
+		return "", &ChunkError{Hash: hash, Err: err}
 	}
+	if err := se.chunks.Put(hash, stored); err != nil {
+		return "", &ChunkError{Hash: hash, Err: err}
+	}
+	return codec, nil
+}
 
-	metadataPath := filepath.Join(se.metadataPath, metadata.FileName+".json")
-	return os.WriteFile(metadataPath, data, 0644)
+// storeCompressedChunk saves a payload already compressed with codec, as
+// received from a peer. The caller must have verified it against hash.
+func (se *StorageEngine) storeCompressedChunk(hash, codec string, payload []byte) error {
+	if err := validateHash(hash); err != nil {
+		return err
+	}
+	stored := payload
+	if codec != CodecNone {
+		stored = wrapChunk(codec, payload)
+	}
+	if err := se.chunks.Put(hash, stored); err != nil {
+		return &ChunkError{Hash: hash, Err: err}
+	}
+	return nil
 }
 
-// ReassembleFile reconstructs a file from its chunks
+// chunkCodec returns the codec an existing chunk is stored with
+func (se *StorageEngine) chunkCodec(hash string) (string, error) {
+	chunk, err := se.readStoredChunk(hash)
+	if err != nil {
+		return "", err
+	}
+	return chunk.Codec, nil
+}
+
+// ReassembleFile reconstructs a file from its chunks and restores its
+// recorded attributes
 func (se *StorageEngine) ReassembleFile(metadata *FileMetadata, outputPath string) error {
+	if len(metadata.ChunkHashes) != len(metadata.ChunkSizes) {
+		return fmt.Errorf("metadata for %s lists %d hashes but %d sizes",
+			metadata.FileName, len(metadata.ChunkHashes), len(metadata.ChunkSizes))
+	}
+
+	chunks, err := se.fileChunks(metadata)
+	if err != nil {
+		return err
+	}
+
 	outFile, err := os.Create(outputPath)
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %v", err)
 	}
 	defer outFile.Close()
 
-	for i, hash := range metadata.ChunkHashes {
-		chunkPath := filepath.Join(se.basePath, hash)
-		chunkData, err := os.ReadFile(chunkPath)
+	for i := range metadata.ChunkHashes {
+		// Read and verify chunk
+		chunkData, err := chunks.read(i)
 		if err != nil {
-			return fmt.Errorf("failed to read chunk %s: %v", hash, err)
-		}
-
-		// Verify chunk size
-		if int64(len(chunkData)) != metadata.ChunkSizes[i] {
-			return fmt.Errorf("chunk size mismatch for %s", hash)
-		}
-
-		// Verify chunk hash
-		actualHash := sha256.Sum256(chunkData)
-		if hex.EncodeToString(actualHash[:]) != hash {
-			return fmt.Errorf("chunk hash mismatch for %s", hash)
+			return fmt.Errorf("failed to read chunk: %w", err)
 		}
 
 		if _, err := outFile.Write(chunkData); err != nil {
@@ -148,22 +625,31 @@ func (se *StorageEngine) ReassembleFile(metadata *FileMetadata, outputPath strin
 		}
 	}
 
-	return nil
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %v", err)
+	}
+	return applyAttributes(outputPath, metadata.Attributes)
 }
 
 func (se *StorageEngine) readMetadata(fileName string) (*FileMetadata, error) {
-	metadataPath := filepath.Join(se.metadataPath, fileName+".json")
-	data, err := os.ReadFile(metadataPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read metadata file: %v", err)
+	if err := validateFileName(fileName); err != nil {
+		return nil, err
 	}
+	var metadata *FileMetadata
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		var err error
+		metadata, err = getFile(tx, fileName)
+		return err
+	})
+	return metadata, err
+}
 
-	var metadata FileMetadata
-	if err := json.Unmarshal(data, &metadata); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
+func marshalMetadata(metadata *FileMetadata) ([]byte, error) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %v", err)
 	}
-
-	return &metadata, nil
+	return data, nil
 }
 
 func main() {
@@ -173,6 +659,14 @@ func main() {
 		return
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(engine, os.Args[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Example usage
 	filePath := "example.txt"
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
@@ -184,10 +678,125 @@ func main() {
 		fmt.Printf("Failed to split file: %v\n", err)
 		return
 	}
+	fmt.Printf("Stored %s: %d new bytes, %d deduplicated bytes\n",
+		metadata.FileName, metadata.Stats.NewBytes, metadata.Stats.DedupBytes)
 
-	outputPath := "reassembled_" + metadata.FileName
+	outputPath := "reassembled_" + path.Base(metadata.FileName)
 	if err := engine.ReassembleFile(metadata, outputPath); err != nil {
 		fmt.Printf("Failed to reassemble file: %v\n", err)
 		return
 	}
 }
+
+const usage = `usage:
+  import <local dir> [logical dir]   store a directory tree
+  export <logical dir> <local dir>   restore a directory tree
+  chunk <hash>                       show a chunk's state and the files using it
+  repair <hash> <peer address>       repair the files using a chunk from a peer
+  scrub [peer address...]            verify every chunk, re-fetching bad ones from peers`
+
+// runCommand runs a command line subcommand against the engine
+func runCommand(engine *StorageEngine, args []string) error {
+	var (
+		report *TreeReport
+		err    error
+	)
+	switch {
+	case args[0] == "import" && (len(args) == 2 || len(args) == 3):
+		prefix := ""
+		if len(args) == 3 {
+			prefix = args[2]
+		}
+		report, err = engine.ImportTree(args[1], prefix)
+	case args[0] == "export" && len(args) == 3:
+		report, err = engine.ExportTree(args[1], args[2])
+	case args[0] == "chunk" && len(args) == 2:
+		return printChunkReport(engine, args[1])
+	case args[0] == "repair" && len(args) == 3:
+		return repairFromPeer(engine, args[1], args[2])
+	case args[0] == "scrub":
+		return scrub(engine, args[1:])
+	default:
+		return errors.New(usage)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d files, %d stored, %d unchanged, %d bytes\n",
+		args[0], report.Files, report.Stored, report.Unchanged, report.Bytes)
+	for _, skipped := range report.Skipped {
+		fmt.Printf("skipped %s\n", skipped)
+	}
+	return nil
+}
+
+// printChunkReport prints a chunk's state and every file version using it
+func printChunkReport(engine *StorageEngine, hash string) error {
+	report, err := engine.InspectChunk(hash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("chunk %s: %s\n", report.Hash, report.Status)
+	if report.Error != "" {
+		fmt.Printf("  %s\n", report.Error)
+	}
+	for _, ref := range report.References {
+		current := ""
+		if ref.Current {
+			current = " (current)"
+		}
+		fmt.Printf("  %s version %d%s at chunk %s\n",
+			ref.FileName, ref.Version, current, strings.Trim(fmt.Sprint(ref.Indexes), "[]"))
+	}
+	fmt.Printf("%d files, %d versions affected\n", len(report.Files()), len(report.References))
+	return nil
+}
+
+// repairFromPeer repairs every file using a chunk with copies from a peer
+func repairFromPeer(engine *StorageEngine, hash, peerAddr string) error {
+	report, err := newP2PClient(engine).RepairFromPeer(peerAddr, hash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("repair: %d files, %d chunks checked, %d repaired, %d failed\n",
+		len(report.Files), report.Checked, len(report.Repaired), len(report.Failed))
+	for h, reason := range report.Failed {
+		fmt.Printf("failed %s: %s\n", h, reason)
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d chunks could not be repaired", len(report.Failed))
+	}
+	return nil
+}
+
+// scrub verifies every chunk once, re-fetching corrupt chunks from peers
+func scrub(engine *StorageEngine, peers []string) error {
+	var opts ScrubOptions
+	if len(peers) > 0 {
+		node := newP2PClient(engine)
+		for _, peer := range peers {
+			node.AddPeer(peer)
+		}
+		opts.Repair = node.fetchFromPeers
+	}
+	report, err := engine.Scrub(opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("scrub: %d chunks, %d bytes checked, %d corrupt, %d repaired\n",
+		report.ChunksChecked, report.BytesChecked, len(report.Corrupt), len(report.Repaired))
+	for _, hash := range report.Corrupt {
+		fmt.Printf("corrupt %s\n", hash)
+	}
+	for _, name := range report.Affected {
+		fmt.Printf("affected %s\n", name)
+	}
+	for hash, reason := range report.Failed {
+		fmt.Printf("failed %s: %s\n", hash, reason)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Leaves and interior nodes are hashed with different prefixes so an
+// interior node can never be passed off as a leaf
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// ErrInvalidProof is returned when a chunk does not prove into a file's
+// Merkle root
+var ErrInvalidProof = errors.New("invalid merkle proof")
+
+// MerkleTree is a binary hash tree over a file's chunk hashes. A level with
+// an odd number of nodes promotes its last node unchanged.
+type MerkleTree struct {
+	// levels[0] holds the leaves and the last level holds the root
+	levels [][][]byte
+}
+
+// MerkleProof holds the sibling hashes from a leaf up to the root. Index
+// and LeafCount fix the leaf's position, so a proof for one chunk cannot be
+// replayed for another.
+type MerkleProof struct {
+	Index     int      `json:"index"`
+	LeafCount int      `json:"leafCount"`
+	Siblings  []string `json:"siblings"`
+}
+
+// NewMerkleTree builds the tree over hex encoded chunk hashes
+func NewMerkleTree(chunkHashes []string) (*MerkleTree, error) {
+	leaves := make([][]byte, len(chunkHashes))
+	for i, hash := range chunkHashes {
+		leaf, err := merkleLeaf(hash)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+	}
+
+	tree := &MerkleTree{levels: [][][]byte{leaves}}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		tree.levels = append(tree.levels, next)
+		level = next
+	}
+	return tree, nil
+}
+
+// Root returns the hex encoded root hash. The root of a file without
+// chunks is the hash of no data.
+func (t *MerkleTree) Root() string {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+	return hex.EncodeToString(top[0])
+}
+
+// Proof returns the proof for the chunk at index
+func (t *MerkleTree) Proof(index int) (*MerkleProof, error) {
+	leafCount := len(t.levels[0])
+	if index < 0 || index >= leafCount {
+		return nil, fmt.Errorf("chunk index %d out of range", index)
+	}
+
+	proof := &MerkleProof{Index: index, LeafCount: leafCount, Siblings: []string{}}
+	pos := index
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := pos ^ 1
+		if sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, hex.EncodeToString(level[sibling]))
+		}
+		pos /= 2
+	}
+	return proof, nil
+}
+
+// MerkleRoot returns the root of the tree over chunkHashes
+func MerkleRoot(chunkHashes []string) (string, error) {
+	tree, err := NewMerkleTree(chunkHashes)
+	if err != nil {
+		return "", err
+	}
+	return tree.Root(), nil
+}
+
+// VerifyMerkleProof checks that chunkHash sits at proof.Index of a tree with
+// the given root
+func VerifyMerkleProof(root, chunkHash string, proof *MerkleProof) error {
+	if proof == nil {
+		return fmt.Errorf("%w: missing proof", ErrInvalidProof)
+	}
+	if proof.Index < 0 || proof.Index >= proof.LeafCount {
+		return fmt.Errorf("%w: index %d out of range", ErrInvalidProof, proof.Index)
+	}
+	expected, err := hex.DecodeString(root)
+	if err != nil {
+		return fmt.Errorf("%w: malformed root", ErrInvalidProof)
+	}
+
+	current, err := merkleLeaf(chunkHash)
+	if err != nil {
+		return err
+	}
+	siblings := proof.Siblings
+	for pos, width := proof.Index, proof.LeafCount; width > 1; pos, width = pos/2, (width+1)/2 {
+		if pos%2 == 0 && pos+1 == width {
+			// Promoted without a sibling
+			continue
+		}
+		if len(siblings) == 0 {
+			return fmt.Errorf("%w: too few siblings", ErrInvalidProof)
+		}
+		sibling, err := hex.DecodeString(siblings[0])
+		if err != nil {
+			return fmt.Errorf("%w: malformed sibling", ErrInvalidProof)
+		}
+		siblings = siblings[1:]
+		if pos%2 == 0 {
+			current = merkleNode(current, sibling)
+		} else {
+			current = merkleNode(sibling, current)
+		}
+	}
+
+	if len(siblings) != 0 {
+		return fmt.Errorf("%w: too many siblings", ErrInvalidProof)
+	}
+	if !bytes.Equal(current, expected) {
+		return fmt.Errorf("%w: root mismatch", ErrInvalidProof)
+	}
+	return nil
+}
+
+func merkleLeaf(chunkHash string) ([]byte, error) {
+	if err := validateHash(chunkHash); err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(chunkHash)
+	if err != nil {
+		return nil, &ChunkError{Hash: chunkHash, Err: ErrInvalidHash}
+	}
+	sum := sha256.Sum256(append([]byte{merkleLeafPrefix}, raw...))
+	return sum[:], nil
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
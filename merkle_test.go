@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleProofs(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		hashes := make([]string, count)
+		for i := range hashes {
+			hashes[i] = chunkHash([]byte(fmt.Sprintf("chunk %d", i)))
+		}
+		tree, err := NewMerkleTree(hashes)
+		if err != nil {
+			t.Fatalf("Failed to build tree: %v", err)
+		}
+		root := tree.Root()
+
+		for i, hash := range hashes {
+			proof, err := tree.Proof(i)
+			if err != nil {
+				t.Fatalf("Failed to build proof %d/%d: %v", i, count, err)
+			}
+			if err := VerifyMerkleProof(root, hash, proof); err != nil {
+				t.Errorf("Valid proof %d/%d rejected: %v", i, count, err)
+			}
+
+			other := chunkHash([]byte("other"))
+			if err := VerifyMerkleProof(root, other, proof); !errors.Is(err, ErrInvalidProof) {
+				t.Errorf("Proof %d/%d accepted a different chunk", i, count)
+			}
+			if count > 1 {
+				moved := *proof
+				moved.Index = (i + 1) % count
+				if err := VerifyMerkleProof(root, hash, &moved); !errors.Is(err, ErrInvalidProof) {
+					t.Errorf("Proof %d/%d accepted at index %d", i, count, moved.Index)
+				}
+			}
+		}
+	}
+}
+
+func TestIngestRecordsMerkleRoot(t *testing.T) {
+	engine := newTestEngine(t)
+
+	data := make([]byte, 3000)
+	metadata, err := engine.Ingest(bytes.NewReader(data), "zeros.bin", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	root, err := MerkleRoot(metadata.ChunkHashes)
+	if err != nil {
+		t.Fatalf("Failed to compute root: %v", err)
+	}
+	if metadata.MerkleRoot != root {
+		t.Errorf("Expected merkle root %s, got %s", root, metadata.MerkleRoot)
+	}
+	if metadata.FileHash != chunkHash(data) {
+		t.Errorf("Expected file hash %s, got %s", chunkHash(data), metadata.FileHash)
+	}
+}
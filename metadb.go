@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// metadataDBName is the BoltDB file holding all metadata, inside the
+// metadata directory
+const metadataDBName = "metadata.db"
+
+// Buckets of the metadata database. Keys join fields with a zero byte,
+// which logical paths and labels may not contain.
+var (
+	// filesBucket maps a path to its current FileMetadata
+	filesBucket = []byte("files")
+	// versionsBucket maps path, 0, big endian version to a FileMetadata
+	versionsBucket = []byte("versions")
+	// dirsBucket maps a directory path to a dirRecord
+	dirsBucket = []byte("dirs")
+	// chunkFilesBucket indexes chunk hash, 0, path for every version
+	chunkFilesBucket = []byte("chunk_files")
+	// sizesBucket indexes big endian size, path for current versions
+	sizesBucket = []byte("sizes")
+	// labelsBucket indexes label key, 0, value, 0, path for current versions
+	labelsBucket = []byte("labels")
+	// rootsBucket indexes Merkle root, 0, path, 0, big endian version for
+	// every version with a root
+	rootsBucket = []byte("roots")
+	// infoBucket holds database level settings such as the migration marker
+	infoBucket = []byte("info")
+)
+
+// dirRecord is stored for every directory in the namespace
+type dirRecord struct {
+	ModTime time.Time `json:"modTime"`
+}
+
+// metadataDB wraps the BoltDB metadata file. Engines opened on the same
+// directory in one process share a handle, since BoltDB locks the file.
+type metadataDB struct {
+	db    *bolt.DB
+	path  string
+	users int
+}
+
+var (
+	metadataDBs   = make(map[string]*metadataDB)
+	metadataDBsMu sync.Mutex
+)
+
+// openMetadataDB opens or creates the metadata database at path
+func openMetadataDB(dbPath string, perm os.FileMode) (*metadataDB, error) {
+	abs, err := filepath.Abs(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataDBsMu.Lock()
+	defer metadataDBsMu.Unlock()
+	if m, exists := metadataDBs[abs]; exists {
+		m.users++
+		return m, nil
+	}
+
+	db, err := bolt.Open(abs, perm, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata database %s: %v", abs, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Databases created before the roots index existed are indexed
+		// when it is added
+		indexRoots := tx.Bucket(rootsBucket) == nil
+		for _, name := range [][]byte{filesBucket, versionsBucket, dirsBucket,
+			chunkFilesBucket, sizesBucket, labelsBucket, rootsBucket, infoBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if indexRoots {
+			return reindexRoots(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create metadata buckets: %v", err)
+	}
+
+	m := &metadataDB{db: db, path: abs, users: 1}
+	metadataDBs[abs] = m
+	return m, nil
+}
+
+// close releases this user's handle, closing the database with the last one
+func (m *metadataDB) close() error {
+	metadataDBsMu.Lock()
+	defer metadataDBsMu.Unlock()
+	m.users--
+	if m.users > 0 {
+		return nil
+	}
+	delete(metadataDBs, m.path)
+	return m.db.Close()
+}
+
+func (m *metadataDB) view(fn func(tx *bolt.Tx) error) error {
+	return m.db.View(fn)
+}
+
+func (m *metadataDB) update(fn func(tx *bolt.Tx) error) error {
+	return m.db.Update(fn)
+}
+
+func decodeMetadata(data []byte) (*FileMetadata, error) {
+	var metadata FileMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
+	}
+	return &metadata, nil
+}
+
+func joinKey(fields ...[]byte) []byte {
+	return bytes.Join(fields, []byte{0})
+}
+
+func versionKey(name string, version int) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(version))
+	return joinKey([]byte(name), v)
+}
+
+// splitVersionKey returns the file name and version a versionKey encodes
+func splitVersionKey(key []byte) (string, int) {
+	if len(key) < 9 {
+		return "", 0
+	}
+	sep := len(key) - 9
+	return string(key[:sep]), int(binary.BigEndian.Uint64(key[sep+1:]))
+}
+
+func sizeKey(size int64, name string) []byte {
+	key := make([]byte, 8, 8+len(name))
+	binary.BigEndian.PutUint64(key, uint64(size))
+	return append(key, name...)
+}
+
+func labelKey(key, value, name string) []byte {
+	return joinKey([]byte(key), []byte(value), []byte(name))
+}
+
+func rootKey(root, name string, version int) []byte {
+	return joinKey([]byte(root), versionKey(name, version))
+}
+
+// scanPrefix calls fn for every key in bucket starting with prefix, in key
+// order, until fn returns false or an error
+func scanPrefix(b *bolt.Bucket, prefix []byte, fn func(k, v []byte) (bool, error)) error {
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		more, err := fn(k, v)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// getFile returns the current metadata of a file
+func getFile(tx *bolt.Tx, name string) (*FileMetadata, error) {
+	data := tx.Bucket(filesBucket).Get([]byte(name))
+	if data == nil {
+		return nil, fmt.Errorf("no metadata for %s: %w", name, os.ErrNotExist)
+	}
+	metadata, err := decodeMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	metadata.FileName = name
+	return metadata, nil
+}
+
+func isFile(tx *bolt.Tx, name string) bool {
+	return tx.Bucket(filesBucket).Get([]byte(name)) != nil
+}
+
+func isDir(tx *bolt.Tx, name string) bool {
+	return name == "" || tx.Bucket(dirsBucket).Get([]byte(name)) != nil
+}
+
+// putFile makes metadata the current version of its file and reindexes it
+func putFile(tx *bolt.Tx, metadata *FileMetadata) error {
+	if previous, err := getFile(tx, metadata.FileName); err == nil {
+		if err := unindexFile(tx, previous); err != nil {
+			return err
+		}
+	}
+
+	data, err := marshalMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	name := metadata.FileName
+	if err := tx.Bucket(filesBucket).Put([]byte(name), data); err != nil {
+		return err
+	}
+	if err := tx.Bucket(sizesBucket).Put(sizeKey(metadata.TotalSize, name), nil); err != nil {
+		return err
+	}
+	if metadata.Attributes != nil {
+		for key, value := range metadata.Attributes.Labels {
+			if err := tx.Bucket(labelsBucket).Put(labelKey(key, value, name), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unindexFile removes the size and label entries of a current version
+func unindexFile(tx *bolt.Tx, metadata *FileMetadata) error {
+	name := metadata.FileName
+	if err := tx.Bucket(sizesBucket).Delete(sizeKey(metadata.TotalSize, name)); err != nil {
+		return err
+	}
+	if metadata.Attributes != nil {
+		for key, value := range metadata.Attributes.Labels {
+			if err := tx.Bucket(labelsBucket).Delete(labelKey(key, value, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// putVersion stores metadata in its file's history and indexes its chunks
+func putVersion(tx *bolt.Tx, metadata *FileMetadata) error {
+	data, err := marshalMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	name := metadata.FileName
+	if err := tx.Bucket(versionsBucket).Put(versionKey(name, metadata.Version), data); err != nil {
+		return err
+	}
+	for hash := range uniqueChunks(metadata) {
+		if err := tx.Bucket(chunkFilesBucket).Put(joinKey([]byte(hash), []byte(name)), nil); err != nil {
+			return err
+		}
+	}
+	if metadata.MerkleRoot != "" {
+		return tx.Bucket(rootsBucket).Put(rootKey(metadata.MerkleRoot, name, metadata.Version), nil)
+	}
+	return nil
+}
+
+// reindexRoots adds every stored version to the roots index
+func reindexRoots(tx *bolt.Tx) error {
+	return tx.Bucket(versionsBucket).ForEach(func(k, v []byte) error {
+		metadata, err := decodeMetadata(v)
+		if err != nil {
+			return err
+		}
+		if metadata.MerkleRoot == "" {
+			return nil
+		}
+		return tx.Bucket(rootsBucket).Put(joinKey([]byte(metadata.MerkleRoot), k), nil)
+	})
+}
+
+// versionsOf returns the history of a file, oldest first
+func versionsOf(tx *bolt.Tx, name string) ([]*FileMetadata, error) {
+	var versions []*FileMetadata
+	err := scanPrefix(tx.Bucket(versionsBucket), joinKey([]byte(name), nil), func(k, v []byte) (bool, error) {
+		metadata, err := decodeMetadata(v)
+		if err != nil {
+			return false, err
+		}
+		metadata.FileName = name
+		versions = append(versions, metadata)
+		return true, nil
+	})
+	return versions, err
+}
+
+// removeFile deletes a file's current document, history and index
+// entries, returning every version it had
+func removeFile(tx *bolt.Tx, name string) ([]*FileMetadata, error) {
+	current, err := getFile(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := versionsOf(tx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unindexFile(tx, current); err != nil {
+		return nil, err
+	}
+	if err := tx.Bucket(filesBucket).Delete([]byte(name)); err != nil {
+		return nil, err
+	}
+	for _, metadata := range versions {
+		if err := tx.Bucket(versionsBucket).Delete(versionKey(name, metadata.Version)); err != nil {
+			return nil, err
+		}
+		for hash := range uniqueChunks(metadata) {
+			if err := tx.Bucket(chunkFilesBucket).Delete(joinKey([]byte(hash), []byte(name))); err != nil {
+				return nil, err
+			}
+		}
+		if metadata.MerkleRoot != "" {
+			if err := tx.Bucket(rootsBucket).Delete(rootKey(metadata.MerkleRoot, name, metadata.Version)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return versions, nil
+}
+
+// checkParents verifies that no ancestor of name is a file
+func checkParents(tx *bolt.Tx, name string) error {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if isFile(tx, dir) {
+			return fmt.Errorf("%s: %w", dir, ErrNotDirectory)
+		}
+	}
+	return nil
+}
+
+// checkFilePath verifies that a file can be stored at name
+func checkFilePath(tx *bolt.Tx, name string) error {
+	if isDir(tx, name) {
+		return fmt.Errorf("%s: %w", name, ErrIsDirectory)
+	}
+	return checkParents(tx, name)
+}
+
+// ensureDir creates dir and any missing parents
+func ensureDir(tx *bolt.Tx, dir string) error {
+	if dir == "." || isDir(tx, dir) {
+		return nil
+	}
+	if isFile(tx, dir) {
+		return fmt.Errorf("%s: %w", dir, ErrNotDirectory)
+	}
+	if err := ensureDir(tx, path.Dir(dir)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(dirRecord{ModTime: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(dirsBucket).Put([]byte(dir), data)
+}
+
+// hasChildren reports whether anything is stored below dir
+func hasChildren(tx *bolt.Tx, dir string) bool {
+	prefix := []byte(dir + "/")
+	for _, bucket := range [][]byte{filesBucket, dirsBucket} {
+		k, _ := tx.Bucket(bucket).Cursor().Seek(prefix)
+		if k != nil && bytes.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMetadataIndex(t *testing.T) {
+	engine := newTestEngine(t)
+
+	for i, size := range []int{100, 2000, 3000, 5000} {
+		name := fmt.Sprintf("logs/day%d.log", i)
+		if _, err := engine.Ingest(bytes.NewReader(bytes.Repeat([]byte{byte('a' + i)}, size)), name, IngestOptions{}); err != nil {
+			t.Fatalf("Failed to ingest %s: %v", name, err)
+		}
+	}
+	shared := bytes.Repeat([]byte("s"), 1024)
+	metadata, err := engine.Ingest(bytes.NewReader(shared), "other/copy.bin", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if _, err := engine.Ingest(bytes.NewReader(append(shared, 'x')), "logs/day0.log", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	// Paginate through the logs two at a time
+	var names []string
+	after := ""
+	for page := 0; page < 3; page++ {
+		list, err := engine.ListFiles("logs/", after, 2)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		for _, file := range list.Files {
+			names = append(names, file.FileName)
+		}
+		if after = list.Next; after == "" {
+			break
+		}
+	}
+	if fmt.Sprint(names) != "[logs/day0.log logs/day1.log logs/day2.log logs/day3.log]" || after != "" {
+		t.Errorf("Unexpected pages: %v, next %q", names, after)
+	}
+	if count, _ := engine.CountFiles("logs/"); count != 4 {
+		t.Errorf("Expected 4 logs, counted %d", count)
+	}
+
+	// Version 2 of day0.log shares the chunk with copy.bin
+	files, err := engine.FilesWithChunk(metadata.ChunkHashes[0])
+	if err != nil {
+		t.Fatalf("Failed to look up chunk: %v", err)
+	}
+	if fmt.Sprint(files) != "[logs/day0.log other/copy.bin]" {
+		t.Errorf("Unexpected files for chunk: %v", files)
+	}
+
+	bySize, err := engine.FindFiles(FileQuery{MinSize: 1026, MaxSize: 3000})
+	if err != nil {
+		t.Fatalf("Failed to query by size: %v", err)
+	}
+	if len(bySize) != 2 || bySize[0].FileName != "logs/day1.log" || bySize[1].FileName != "logs/day2.log" {
+		t.Errorf("Unexpected size query results: %d files", len(bySize))
+	}
+
+	if _, err := engine.SetLabels("logs/day3.log", map[string]string{"tier": "cold"}); err != nil {
+		t.Fatalf("Failed to set labels: %v", err)
+	}
+	if _, err := engine.SetLabels("logs/day3.log", map[string]string{"tier": "archive"}); err != nil {
+		t.Fatalf("Failed to set labels: %v", err)
+	}
+	if cold, _ := engine.FindFiles(FileQuery{Labels: map[string]string{"tier": "cold"}}); len(cold) != 0 {
+		t.Errorf("Stale label still indexed: %d files", len(cold))
+	}
+	tiered, _ := engine.FindFiles(FileQuery{Labels: map[string]string{"tier": ""}, MinSize: 4000})
+	if len(tiered) != 1 || tiered[0].FileName != "logs/day3.log" {
+		t.Errorf("Unexpected label query results: %d files", len(tiered))
+	}
+
+	// copy.bin and version 2 of day0.log differ, but version 1 of day0.log
+	// is found by its root, also once the index is rebuilt
+	day0, err := engine.ReadVersion("logs/day0.log", 1)
+	if err != nil {
+		t.Fatalf("Failed to read version: %v", err)
+	}
+	for _, rebuild := range []bool{false, true} {
+		if rebuild {
+			err := engine.meta.update(func(tx *bolt.Tx) error {
+				if err := tx.DeleteBucket(rootsBucket); err != nil {
+					return err
+				}
+				if _, err := tx.CreateBucket(rootsBucket); err != nil {
+					return err
+				}
+				return reindexRoots(tx)
+			})
+			if err != nil {
+				t.Fatalf("Failed to rebuild roots: %v", err)
+			}
+		}
+		found, err := engine.FileByRoot(day0.MerkleRoot, "")
+		if err != nil || found.FileName != "logs/day0.log" || found.Version != 1 {
+			t.Errorf("Unexpected file for root: %+v, %v", found, err)
+		}
+		if _, err := engine.FileByRoot(day0.MerkleRoot, "other/copy.bin"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected root lookup in another file to fail, got %v", err)
+		}
+	}
+}
+
+func TestVersionKey(t *testing.T) {
+	for _, version := range []int{1, 256, 1 << 40} {
+		name, got := splitVersionKey(versionKey("docs/a.txt", version))
+		if name != "docs/a.txt" || got != version {
+			t.Errorf("Version key for %d split into %q, %d", version, name, got)
+		}
+	}
+}
+
+func TestMigrateJSONMetadata(t *testing.T) {
+	root := t.TempDir()
+	metadataDir := filepath.Join(root, "metadata")
+	writeDoc := func(rel string, metadata FileMetadata) {
+		t.Helper()
+		data, _ := json.Marshal(metadata)
+		p := filepath.Join(metadataDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := chunkHash([]byte("first")), chunkHash([]byte("second"))
+	// A document from before versioning and one with history
+	writeDoc("old.txt.json", FileMetadata{FileName: "old.txt", TotalSize: 5, ChunkHashes: []string{first}})
+	writeDoc("docs/a.txt.json", FileMetadata{FileName: "docs/a.txt", TotalSize: 6, ChunkHashes: []string{second}, Version: 2})
+	writeDoc(".versions/docs/a.txt/1.json", FileMetadata{FileName: "docs/a.txt", TotalSize: 5, ChunkHashes: []string{first}, Version: 1})
+	writeDoc(".versions/docs/a.txt/2.json", FileMetadata{FileName: "docs/a.txt", TotalSize: 6, ChunkHashes: []string{second}, Version: 2})
+	// A half-written document and a file that isn't metadata
+	if err := os.WriteFile(filepath.Join(metadataDir, "broken.txt.json"), []byte(`{"fileName": "bro`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(metadataDir, "README"), []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := NewStorageEngineWithOptions(StorageOptions{RootDir: root, ChunkStore: NewMemoryChunkStore()})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+
+	old, err := engine.readMetadata("old.txt")
+	if err != nil || old.Version != 1 {
+		t.Errorf("Legacy document not migrated as version 1: %v", err)
+	}
+	versions, err := engine.ListVersions("docs/a.txt")
+	if err != nil || len(versions) != 2 || !versions[1].Current {
+		t.Errorf("History not migrated: %+v, %v", versions, err)
+	}
+	if entry, err := engine.Stat("docs"); err != nil || !entry.IsDir {
+		t.Errorf("Directory not migrated: %v", err)
+	}
+	if files, _ := engine.FilesWithChunk(first); len(files) != 2 {
+		t.Errorf("Expected both files to reference the first chunk, got %v", files)
+	}
+
+	if _, err := os.Stat(filepath.Join(metadataDir, "old.txt.json")); !os.IsNotExist(err) {
+		t.Error("Legacy document left in place")
+	}
+	if _, err := os.Stat(filepath.Join(metadataDir, legacyBackupDir, legacyVersionsDir, "docs", "a.txt", "1.json")); err != nil {
+		t.Errorf("History not backed up: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(metadataDir, legacyBackupDir, "docs", "a.txt.json")); err != nil {
+		t.Errorf("Nested document not backed up: %v", err)
+	}
+	if _, err := engine.readMetadata("broken.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected unreadable document to be skipped, got %v", err)
+	}
+	for _, name := range []string{"broken.txt.json", "README"} {
+		if _, err := os.Stat(filepath.Join(metadataDir, name)); err != nil {
+			t.Errorf("%s not left in place: %v", name, err)
+		}
+	}
+	engine.Close()
+
+	// Reopening does not migrate the backup again
+	engine, err = NewStorageEngineWithOptions(StorageOptions{RootDir: root, ChunkStore: NewMemoryChunkStore()})
+	if err != nil {
+		t.Fatalf("Failed to reopen storage engine: %v", err)
+	}
+	defer engine.Close()
+	if count, _ := engine.CountFiles(""); count != 2 {
+		t.Errorf("Expected 2 files after reopening, counted %d", count)
+	}
+}
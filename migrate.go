@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// legacyVersionsDir held per-file history before the metadata database
+	legacyVersionsDir = ".versions"
+	// legacyBackupDir receives the JSON documents once they are migrated
+	legacyBackupDir = "json-backup"
+)
+
+var migratedKey = []byte("migrated")
+
+// migrateJSONMetadata imports metadata stored as one JSON document per
+// file, with history under .versions, into the metadata database. It runs
+// once; afterwards the documents and .versions are moved to
+// metadata/json-backup. Documents that can't be read are reported and left
+// in place.
+func (se *StorageEngine) migrateJSONMetadata() (int, error) {
+	done := false
+	se.meta.view(func(tx *bolt.Tx) error {
+		done = tx.Bucket(infoBucket).Get(migratedKey) != nil
+		return nil
+	})
+	if done {
+		return 0, nil
+	}
+
+	current := make(map[string]*FileMetadata)
+	history := make(map[string][]*FileMetadata)
+	var dirs, docs []string
+	versionsRoot := filepath.Join(se.metadataPath, legacyVersionsDir)
+
+	err := filepath.WalkDir(se.metadataPath, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(se.metadataPath, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := entry.Name()
+		if rel == legacyBackupDir {
+			return filepath.SkipDir
+		}
+
+		switch {
+		case entry.IsDir() && p == versionsRoot:
+		case entry.IsDir() && strings.HasPrefix(p, versionsRoot+string(filepath.Separator)):
+		case entry.IsDir():
+			dirs = append(dirs, filepath.ToSlash(rel))
+		case !strings.HasSuffix(name, ".json") || isTempFile(name):
+		case strings.HasPrefix(p, versionsRoot+string(filepath.Separator)):
+			version, err := strconv.Atoi(strings.TrimSuffix(name, ".json"))
+			if err != nil {
+				return nil
+			}
+			metadata, err := readMetadataFile(p)
+			if err != nil {
+				fmt.Printf("Skipping unreadable metadata %s: %v\n", p, err)
+				return nil
+			}
+			fileRel, _ := filepath.Rel(versionsRoot, filepath.Dir(p))
+			fileName := filepath.ToSlash(fileRel)
+			metadata.FileName, metadata.Version = fileName, version
+			history[fileName] = append(history[fileName], metadata)
+		default:
+			metadata, err := readMetadataFile(p)
+			if err != nil {
+				fmt.Printf("Skipping unreadable metadata %s: %v\n", p, err)
+				return nil
+			}
+			docs = append(docs, rel)
+			metadata.FileName = strings.TrimSuffix(filepath.ToSlash(rel), ".json")
+			current[metadata.FileName] = metadata
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read JSON metadata: %v", err)
+	}
+
+	err = se.meta.update(func(tx *bolt.Tx) error {
+		for _, dir := range dirs {
+			if err := ensureDir(tx, dir); err != nil {
+				return err
+			}
+		}
+		for name, metadata := range current {
+			if validateFileName(name) != nil {
+				fmt.Printf("Skipping metadata with invalid name %q\n", name)
+				continue
+			}
+			// Documents from before versioning become version 1
+			versions := history[name]
+			if len(versions) == 0 {
+				if metadata.Version == 0 {
+					metadata.Version = 1
+				}
+				versions = []*FileMetadata{metadata}
+			}
+			for _, version := range versions {
+				if err := putVersion(tx, version); err != nil {
+					return err
+				}
+			}
+			if err := putFile(tx, metadata); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(infoBucket).Put(migratedKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The database is authoritative from here on; a failure below only
+	// leaves stale documents behind
+	if _, err := os.Stat(versionsRoot); err == nil {
+		docs = append(docs, legacyVersionsDir)
+	}
+	backup := filepath.Join(se.metadataPath, legacyBackupDir)
+	for _, rel := range docs {
+		target := filepath.Join(backup, rel)
+		if err := os.MkdirAll(filepath.Dir(target), se.dirPerm); err != nil {
+			return len(current), fmt.Errorf("failed to create %s: %v", filepath.Dir(target), err)
+		}
+		if err := os.Rename(filepath.Join(se.metadataPath, rel), target); err != nil {
+			return len(current), fmt.Errorf("failed to move %s to %s: %v", rel, backup, err)
+		}
+	}
+	// Directories emptied by the move go too, deepest first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(filepath.Join(se.metadataPath, filepath.FromSlash(dirs[i])))
+	}
+	return len(current), nil
+}
+
+// readMetadataFile reads a JSON metadata document
+func readMetadataFile(path string) (*FileMetadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata file: %w", err)
+	}
+
+	var metadata FileMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
+	}
+
+	return &metadata, nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Files are named by logical paths: slash separated, relative to the root
+// of the namespace and clean, such as "reports/2024/q1.csv". Directories
+// are recorded explicitly, and storing a file creates its missing parents.
+
+var (
+	// ErrIsDirectory is returned when a file operation names a directory
+	ErrIsDirectory = errors.New("is a directory")
+	// ErrNotDirectory is returned when a path component is a file
+	ErrNotDirectory = errors.New("not a directory")
+)
+
+// DirEntry describes a file or directory in the namespace
+type DirEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"isDir"`
+	Size    int64     `json:"size,omitempty"`
+	Version int       `json:"version,omitempty"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// LogicalPath converts a local file path into the logical path SplitFile
+// stores it under. Volume names, leading separators and leading ".."
+// elements are dropped.
+func LogicalPath(filePath string) string {
+	p := filepath.ToSlash(filepath.Clean(strings.TrimPrefix(filePath, filepath.VolumeName(filePath))))
+	for {
+		switch {
+		case strings.HasPrefix(p, "/"):
+			p = p[1:]
+		case p == "..":
+			p = ""
+		case strings.HasPrefix(p, "../"):
+			p = p[3:]
+		default:
+			return p
+		}
+	}
+}
+
+// validateDirPath is like validateFileName but also accepts "" for the
+// root directory
+func validateDirPath(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	return validateFileName(dir)
+}
+
+// checkFilePath verifies that a file can be stored at name. The result is
+// only a hint; commitMetadata checks again when storing.
+func (se *StorageEngine) checkFilePath(name string) error {
+	return se.meta.view(func(tx *bolt.Tx) error {
+		return checkFilePath(tx, name)
+	})
+}
+
+// Mkdir creates a directory and any missing parents
+func (se *StorageEngine) Mkdir(dir string) error {
+	if err := validateFileName(dir); err != nil {
+		return err
+	}
+	return se.meta.update(func(tx *bolt.Tx) error {
+		if isFile(tx, dir) {
+			return fmt.Errorf("%s: %w", dir, os.ErrExist)
+		}
+		return ensureDir(tx, dir)
+	})
+}
+
+// RemoveDir removes an empty directory
+func (se *StorageEngine) RemoveDir(dir string) error {
+	if err := validateFileName(dir); err != nil {
+		return err
+	}
+	return se.meta.update(func(tx *bolt.Tx) error {
+		if !isDir(tx, dir) {
+			return fmt.Errorf("failed to remove directory %s: %w", dir, os.ErrNotExist)
+		}
+		if hasChildren(tx, dir) {
+			return fmt.Errorf("failed to remove directory %s: not empty", dir)
+		}
+		return tx.Bucket(dirsBucket).Delete([]byte(dir))
+	})
+}
+
+// Stat describes the file or directory at p
+func (se *StorageEngine) Stat(p string) (*DirEntry, error) {
+	if err := validateDirPath(p); err != nil {
+		return nil, err
+	}
+
+	var entry *DirEntry
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		if isDir(tx, p) {
+			var err error
+			entry, err = dirEntry(tx, p)
+			return err
+		}
+		metadata, err := getFile(tx, p)
+		if err != nil {
+			return err
+		}
+		entry = fileEntry(metadata)
+		return nil
+	})
+	return entry, err
+}
+
+func dirEntry(tx *bolt.Tx, dir string) (*DirEntry, error) {
+	entry := &DirEntry{Name: path.Base(dir), Path: dir, IsDir: true}
+	if data := tx.Bucket(dirsBucket).Get([]byte(dir)); data != nil {
+		var record dirRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal directory %s: %v", dir, err)
+		}
+		entry.ModTime = record.ModTime
+	}
+	return entry, nil
+}
+
+func fileEntry(metadata *FileMetadata) *DirEntry {
+	return &DirEntry{
+		Name:    path.Base(metadata.FileName),
+		Path:    metadata.FileName,
+		Size:    metadata.TotalSize,
+		Version: metadata.Version,
+		ModTime: metadata.CreatedAt,
+	}
+}
+
+// ListDir lists the files and directories directly inside dir, sorted by
+// name. The root directory is "".
+func (se *StorageEngine) ListDir(dir string) ([]DirEntry, error) {
+	if err := validateDirPath(dir); err != nil {
+		return nil, err
+	}
+
+	var listing []DirEntry
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		if !isDir(tx, dir) {
+			if isFile(tx, dir) {
+				return fmt.Errorf("%s: %w", dir, ErrNotDirectory)
+			}
+			return fmt.Errorf("failed to list %q: %w", dir, os.ErrNotExist)
+		}
+
+		var dirs, files []DirEntry
+		err := eachChild(tx.Bucket(dirsBucket), dir, func(name string, _ []byte) error {
+			entry, err := dirEntry(tx, name)
+			if err == nil {
+				dirs = append(dirs, *entry)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		err = eachChild(tx.Bucket(filesBucket), dir, func(name string, data []byte) error {
+			metadata, err := decodeMetadata(data)
+			if err != nil {
+				return err
+			}
+			metadata.FileName = name
+			files = append(files, *fileEntry(metadata))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		listing = mergeEntries(dirs, files)
+		return nil
+	})
+	return listing, err
+}
+
+// eachChild calls fn for keys of bucket directly inside dir, skipping
+// whole subtrees with a single seek
+func eachChild(b *bolt.Bucket, dir string, fn func(name string, v []byte) error) error {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	c := b.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); {
+		rest := string(k[len(prefix):])
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			// '0' sorts right after '/', so this lands past the subtree
+			k, v = c.Seek([]byte(prefix + rest[:i] + "0"))
+			continue
+		}
+		if err := fn(string(k), v); err != nil {
+			return err
+		}
+		k, v = c.Next()
+	}
+	return nil
+}
+
+// mergeEntries merges two name sorted listings
+func mergeEntries(a, b []DirEntry) []DirEntry {
+	merged := make([]DirEntry, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0].Name < b[0].Name {
+			merged, a = append(merged, a[0]), a[1:]
+		} else {
+			merged, b = append(merged, b[0]), b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// Rename moves a file, with its history, or a whole directory to a new
+// path. The destination must not exist; missing parents are created.
+func (se *StorageEngine) Rename(oldPath, newPath string) error {
+	if err := validateFileName(oldPath); err != nil {
+		return err
+	}
+	if err := validateFileName(newPath); err != nil {
+		return err
+	}
+	if oldPath == newPath {
+		return nil
+	}
+
+	return se.meta.update(func(tx *bolt.Tx) error {
+		if isFile(tx, newPath) || isDir(tx, newPath) {
+			return fmt.Errorf("%s: %w", newPath, os.ErrExist)
+		}
+		if isFile(tx, oldPath) {
+			if err := ensureDir(tx, path.Dir(newPath)); err != nil {
+				return err
+			}
+			return moveFile(tx, oldPath, newPath)
+		}
+		if !isDir(tx, oldPath) {
+			return fmt.Errorf("%s: %w", oldPath, os.ErrNotExist)
+		}
+		if strings.HasPrefix(newPath, oldPath+"/") {
+			return fmt.Errorf("cannot move %s inside itself", oldPath)
+		}
+		if err := ensureDir(tx, path.Dir(newPath)); err != nil {
+			return err
+		}
+		return moveDir(tx, oldPath, newPath)
+	})
+}
+
+// moveFile moves a file's documents and index entries to a new path
+func moveFile(tx *bolt.Tx, oldPath, newPath string) error {
+	current, err := getFile(tx, oldPath)
+	if err != nil {
+		return err
+	}
+	versions, err := removeFile(tx, oldPath)
+	if err != nil {
+		return err
+	}
+	for _, metadata := range versions {
+		metadata.FileName = newPath
+		if err := putVersion(tx, metadata); err != nil {
+			return err
+		}
+	}
+	current.FileName = newPath
+	return putFile(tx, current)
+}
+
+// moveDir moves a directory and everything below it
+func moveDir(tx *bolt.Tx, oldPath, newPath string) error {
+	prefix := []byte(oldPath + "/")
+	var files, dirs []string
+	collect := func(names *[]string) func(k, _ []byte) (bool, error) {
+		return func(k, _ []byte) (bool, error) {
+			*names = append(*names, string(k))
+			return true, nil
+		}
+	}
+	if err := scanPrefix(tx.Bucket(filesBucket), prefix, collect(&files)); err != nil {
+		return err
+	}
+	if err := scanPrefix(tx.Bucket(dirsBucket), prefix, collect(&dirs)); err != nil {
+		return err
+	}
+	dirs = append(dirs, oldPath)
+
+	b := tx.Bucket(dirsBucket)
+	for _, dir := range dirs {
+		record := append([]byte(nil), b.Get([]byte(dir))...)
+		if err := b.Delete([]byte(dir)); err != nil {
+			return err
+		}
+		if err := b.Put([]byte(newPath+dir[len(oldPath):]), record); err != nil {
+			return err
+		}
+	}
+	for _, name := range files {
+		if err := moveFile(tx, name, newPath+name[len(oldPath):]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move moves a file or directory into dir, keeping its name
+func (se *StorageEngine) Move(p, dir string) error {
+	if err := validateDirPath(dir); err != nil {
+		return err
+	}
+	return se.Rename(p, path.Join(dir, path.Base(p)))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestNamespaceSameNameInDirectories(t *testing.T) {
+	engine := newTestEngine(t)
+
+	if _, err := engine.Ingest(bytes.NewReader([]byte("north")), "north/report.csv", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if _, err := engine.Ingest(bytes.NewReader([]byte("south")), "south/report.csv", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	for dir, want := range map[string]string{"north": "north", "south": "south"} {
+		reader, err := engine.Open(dir + "/report.csv")
+		if err != nil {
+			t.Fatalf("Failed to open %s/report.csv: %v", dir, err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+		if string(data) != want {
+			t.Errorf("Expected %q in %s/report.csv, got %q", want, dir, data)
+		}
+	}
+
+	root, err := engine.ListDir("")
+	if err != nil {
+		t.Fatalf("Failed to list root: %v", err)
+	}
+	if len(root) != 2 || !root[0].IsDir || root[0].Name != "north" || root[1].Name != "south" {
+		t.Errorf("Unexpected root listing: %+v", root)
+	}
+
+	for _, name := range []string{"", "/abs", "a/../b", "../up", "a//b", "a\x00b", "a/"} {
+		if _, err := engine.Ingest(bytes.NewReader(nil), name, IngestOptions{}); err == nil {
+			t.Errorf("Expected invalid path %q to be rejected", name)
+		}
+	}
+}
+
+func TestNamespaceDirectoriesAndRename(t *testing.T) {
+	engine := newTestEngine(t)
+
+	if err := engine.Mkdir("docs/drafts"); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if _, err := engine.Ingest(bytes.NewReader([]byte("v1")), "docs/drafts/plan.txt", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if _, err := engine.Ingest(bytes.NewReader([]byte("v2")), "docs/drafts/plan.txt", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	if _, err := engine.Ingest(bytes.NewReader([]byte("x")), "docs/drafts", IngestOptions{}); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("Expected a file over a directory to fail with ErrIsDirectory, got %v", err)
+	}
+	if _, err := engine.Ingest(bytes.NewReader([]byte("x")), "docs/drafts/plan.txt/inner", IngestOptions{}); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("Expected a file below a file to fail with ErrNotDirectory, got %v", err)
+	}
+
+	if err := engine.Rename("docs/drafts/plan.txt", "docs/plan.txt"); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+	versions, err := engine.ListVersions("docs/plan.txt")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected history to move with the file, got %d versions: %v", len(versions), err)
+	}
+
+	if err := engine.Rename("docs", "archive/docs"); err != nil {
+		t.Fatalf("Failed to rename directory: %v", err)
+	}
+	entry, err := engine.Stat("archive/docs/plan.txt")
+	if err != nil {
+		t.Fatalf("Failed to stat moved file: %v", err)
+	}
+	if entry.IsDir || entry.Size != 2 || entry.Version != 2 {
+		t.Errorf("Unexpected entry after move: %+v", entry)
+	}
+	if _, err := engine.Stat("docs"); err == nil {
+		t.Error("Old directory still present after rename")
+	}
+	if err := engine.Rename("archive", "archive/docs/inner"); err == nil {
+		t.Error("Expected moving a directory inside itself to fail")
+	}
+
+	if err := engine.Move("archive/docs/drafts", ""); err != nil {
+		t.Fatalf("Failed to move directory to root: %v", err)
+	}
+	if err := engine.RemoveDir("drafts"); err != nil {
+		t.Errorf("Failed to remove empty directory: %v", err)
+	}
+
+	// GC still sees every version after the moves
+	report, err := engine.CollectGarbage(GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Failed to collect garbage: %v", err)
+	}
+	if len(report.Orphaned) != 0 {
+		t.Errorf("GC orphaned %d chunks of moved files", len(report.Orphaned))
+	}
+}
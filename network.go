@@ -2,26 +2,64 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"path/filepath"
-	"strings"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // ChunkRequest represents a request for a specific chunk
 type ChunkRequest struct {
 	Hash string `json:"hash"`
+	// AcceptCodecs lists codecs the requester can decompress
+	AcceptCodecs []string `json:"acceptCodecs,omitempty"`
+	// FileName and Index ask for a Merkle proof of the chunk's position
+	// in that file. Root pins the version the proof is built from, so a
+	// newer version stored mid-download doesn't break the proof.
+	FileName string `json:"fileName,omitempty"`
+	Index    int    `json:"index,omitempty"`
+	Root     string `json:"root,omitempty"`
 }
 
-// ChunkResponse represents a chunk response
+// ChunkResponse represents a chunk response. Data is compressed with Codec
+// when it is set, and the hash always covers the uncompressed bytes.
 type ChunkResponse struct {
 	Hash string `json:"hash"`
-	Data []byte `json:"data"`
+	// Data travels as the message payload
+	Data  []byte `json:"-"`
+	Codec string `json:"codec,omitempty"`
+	// Proof is set when the request named a file
+	Proof *MerkleProof `json:"proof,omitempty"`
 }
+// HaveQuery names the file of a have request by path, Merkle root or both
+type HaveQuery struct {
+    FileName string `json:"fileName,omitempty"`
+    Root     string `json:"root,omitempty"`
+}
+
+// HaveResult is the response to a have request. Have is a bitmap of the
+// chunks of Metadata the peer holds, chunk i at bit i%8 of byte i/8.
+type HaveResult struct {
+    Metadata *FileMetadata `json:"metadata"`
+    Have     []byte        `json:"have"`
+}
+
+// Holds reports whether the peer holds the chunk at index
+func (r *HaveResult) Holds(index int) bool {
+    return index >= 0 && index/8 < len(r.Have) && r.Have[index/8]&(1<<(index%8)) != 0
+}
+
+// ListResult is the response to a list request
+type ListResult struct {
+    Path    string     `json:"path"`
+    Entries []DirEntry `json:"entries"`
+}
+
 type P2PNode struct {
     storage    *StorageEngine
     connMgr    *ConnectionManager
@@ -30,10 +68,37 @@ type P2PNode struct {
     wg         sync.WaitGroup
     stopping   bool
     stopMutex  sync.RWMutex
+
+    // merkleTrees caches trees by root so serving a file's chunks doesn't
+    // rebuild the tree for every proof
+    merkleTrees map[string]*MerkleTree
+    merkleMutex sync.Mutex
+
+    // peers are asked for good copies of chunks the scrubber finds corrupt
+    peers      map[string]bool
+    peersMutex sync.RWMutex
+    scrubber   *Scrubber
+
+    // Requests on connections beyond maxConnections are answered busy
+    maxConnections int
+    activeConns    atomic.Int32
+
+    // remoteDelete lets peers delete files; delete requests are answered
+    // unauthorized unless it is set
+    remoteDelete atomic.Bool
 }
 
+// defaultMaxConnections bounds the connections a node serves at once
+const defaultMaxConnections = 256
+
 func NewP2PNode(listenAddr string) (*P2PNode, error) {
-    storage, err := NewStorageEngine()
+    return NewP2PNodeWithOptions(listenAddr, StorageOptions{})
+}
+
+// NewP2PNodeWithOptions creates a node whose storage engine uses opts, so
+// several nodes can run in one process without sharing directories
+func NewP2PNodeWithOptions(listenAddr string, opts StorageOptions) (*P2PNode, error) {
+    storage, err := NewStorageEngineWithOptions(opts)
     if err != nil {
         return nil, fmt.Errorf("failed to create storage engine: %v", err)
     }
@@ -42,9 +107,109 @@ func NewP2PNode(listenAddr string) (*P2PNode, error) {
         storage:    storage,
         connMgr:    NewConnectionManager(),
         listenAddr: listenAddr,
+        merkleTrees: make(map[string]*MerkleTree),
+        peers:      make(map[string]bool),
+        maxConnections: defaultMaxConnections,
     }, nil
 }
 
+// newP2PClient returns a node that only makes requests, storing what it
+// fetches in an existing engine
+func newP2PClient(storage *StorageEngine) *P2PNode {
+    return &P2PNode{
+        storage:     storage,
+        connMgr:     NewConnectionManager(),
+        merkleTrees: make(map[string]*MerkleTree),
+        peers:       make(map[string]bool),
+    }
+}
+
+// RepairFromPeer verifies the files using a chunk and replaces missing or
+// corrupt chunks with copies from a peer
+func (n *P2PNode) RepairFromPeer(peerAddr string, hash string) (*RepairReport, error) {
+    return n.storage.RepairAffected(hash, func(h string) error {
+        return n.requestChunk(peerAddr, h)
+    })
+}
+
+// AddPeer records a peer to fetch repaired chunks from
+func (n *P2PNode) AddPeer(peerAddr string) {
+    n.peersMutex.Lock()
+    defer n.peersMutex.Unlock()
+    n.peers[peerAddr] = true
+}
+
+// RemovePeer forgets a peer
+func (n *P2PNode) RemovePeer(peerAddr string) {
+    n.peersMutex.Lock()
+    defer n.peersMutex.Unlock()
+    delete(n.peers, peerAddr)
+}
+
+// Peers returns the known peers, sorted
+func (n *P2PNode) Peers() []string {
+    n.peersMutex.RLock()
+    defer n.peersMutex.RUnlock()
+    peers := make([]string, 0, len(n.peers))
+    for peer := range n.peers {
+        peers = append(peers, peer)
+    }
+    sort.Strings(peers)
+    return peers
+}
+
+// fetchFromPeers requests a chunk from each known peer in turn until one
+// provides a good copy
+func (n *P2PNode) fetchFromPeers(hash string) error {
+    peers := n.Peers()
+    if len(peers) == 0 {
+        return fmt.Errorf("no peers to fetch chunk %s from", hash)
+    }
+
+    var err error
+    for _, peer := range peers {
+        if err = n.requestChunk(peer, hash); err == nil {
+            return nil
+        }
+    }
+    return fmt.Errorf("no peer had a good copy of chunk %s, last error: %v", hash, err)
+}
+
+// StartScrubber scrubs the node's chunks every interval, reading at most
+// bytesPerSecond, and re-fetches corrupt chunks from known peers. It is
+// stopped with the node.
+func (n *P2PNode) StartScrubber(interval time.Duration, bytesPerSecond int64) *Scrubber {
+    n.stopMutex.Lock()
+    defer n.stopMutex.Unlock()
+    if n.scrubber != nil {
+        n.scrubber.Stop()
+    }
+    n.scrubber = n.storage.StartScrubber(interval, ScrubOptions{
+        BytesPerSecond: bytesPerSecond,
+        Repair:         n.fetchFromPeers,
+    })
+    return n.scrubber
+}
+
+// UseJSONWire makes the node speak JSON messages to peers instead of the
+// binary protocol, which is easier to inspect when debugging. Incoming
+// connections are accepted in either form.
+func (n *P2PNode) UseJSONWire(enabled bool) {
+    n.connMgr.SetJSONWire(enabled)
+}
+
+// AllowRemoteDelete lets any peer that can connect delete files and their
+// history. It is off by default.
+func (n *P2PNode) AllowRemoteDelete(enabled bool) {
+    n.remoteDelete.Store(enabled)
+}
+
+// SetMaxConnections limits how many connections the node serves at once.
+// Requests on further connections get a busy error.
+func (n *P2PNode) SetMaxConnections(limit int) {
+    n.maxConnections = limit
+}
+
 func (n *P2PNode) Start() error {
     listener, err := net.Listen("tcp", n.listenAddr)
     if err != nil {
@@ -95,8 +260,14 @@ func (n *P2PNode) isStopping() bool {
 func (n *P2PNode) Stop() {
     n.stopMutex.Lock()
     n.stopping = true
+    scrubber := n.scrubber
     n.stopMutex.Unlock()
 
+    if scrubber != nil {
+        scrubber.Stop()
+    }
+    n.connMgr.CloseAll()
+
     if n.listener != nil {
         n.listener.Close()
     }
@@ -109,140 +280,326 @@ func (n *P2PNode) GetListenAddr() string {
 
 
 
-// Add a helper function to send messages reliably
-func sendMessage(conn net.Conn, msg *Message) error {
-    // Set write deadline
-    if err := conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
-        return fmt.Errorf("failed to set write deadline: %v", err)
-    }
-    
-    // Create an encoder for the connection
-    encoder := json.NewEncoder(conn)
-    if err := encoder.Encode(msg); err != nil {
-        return fmt.Errorf("failed to encode message: %v", err)
-    }
-    
-    return nil
-}
+// HandleConnection handles incoming connections
+func (n *P2PNode) handleConnection(netConn net.Conn) {
+    n.connMgr.AddConnection(netConn)
+    defer func() {
+        n.connMgr.RemoveConnection(netConn)
+        netConn.Close()
+    }()
+
+    active := n.activeConns.Add(1)
+    defer n.activeConns.Add(-1)
 
-// Add a helper function to receive messages reliably
-func receiveMessage(conn net.Conn) (*Message, error) {
-    // Set read deadline
-    if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
-        return nil, fmt.Errorf("failed to set read deadline: %v", err)
+    conn, err := acceptPeer(netConn)
+    if err != nil {
+        if !closedNormally(err) {
+            fmt.Printf("Connection handler error: %v\n", err)
+        }
+        return
     }
-    
-    var msg Message
-    decoder := json.NewDecoder(conn)
-    if err := decoder.Decode(&msg); err != nil {
-        if err == io.EOF {
-            return nil, fmt.Errorf("connection closed by peer")
+
+    if int(active) > n.maxConnections {
+        // Answer rather than drop, so the requester fails fast
+        if msg, err := conn.receive(); err == nil {
+            n.sendError(conn, msg.ID, fmt.Errorf("%w: serving %d connections", ErrBusy, n.maxConnections))
         }
-        return nil, fmt.Errorf("failed to decode message: %v", err)
+        return
     }
-    
-    return &msg, nil
-}
-// HandleConnection handles incoming connections
-func (n *P2PNode) handleConnection(conn net.Conn) {
-    n.connMgr.AddConnection(conn)
-    defer func() {
-        n.connMgr.RemoveConnection(conn)
-        conn.Close()
-    }()
+
+    // Requests are served concurrently and answered as they complete,
+    // matched up by request ID
+    conn.readTimeout = serverIdleTimeout
+    inflight := make(chan struct{}, maxInflightRequests)
+    var handlers sync.WaitGroup
+    defer handlers.Wait()
 
     for {
-        msg, err := receiveMessage(conn)
+        msg, err := conn.receive()
         if err != nil {
-            if !strings.Contains(err.Error(), "timeout") {
+            if !closedNormally(err) {
                 fmt.Printf("Connection handler error: %v\n", err)
             }
             return
         }
 
-        switch MessageType(msg.Type) {
-        case FileRequest:
-            var fileName string
-            if err := json.Unmarshal(msg.Data, &fileName); err != nil {
-                fmt.Printf("Failed to unmarshal file request: %v\n", err)
-                continue
-            }
-            n.handleFileRequest(conn, fileName)
-            
-        case "ChunkRequest":
-            var request ChunkRequest
-            if err := json.Unmarshal(msg.Data, &request); err != nil {
-                fmt.Printf("Failed to unmarshal chunk request: %v\n", err)
-                continue
-            }
-            n.handleChunkRequest(conn, request)
+        inflight <- struct{}{}
+        handlers.Add(1)
+        go func() {
+            defer func() {
+                <-inflight
+                handlers.Done()
+            }()
+            n.handleMessage(conn, msg)
+        }()
+    }
+}
+
+// closedNormally reports whether a read error just means the connection
+// ended: the peer closed it, it sat idle past its deadline or the node is
+// stopping
+func closedNormally(err error) bool {
+    return errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed)
+}
+
+// handleMessage serves one request
+func (n *P2PNode) handleMessage(conn *peerConn, msg *Message) {
+    switch MessageType(msg.Type) {
+    case FileRequest:
+        var fileName string
+        if err := json.Unmarshal(msg.Data, &fileName); err != nil {
+            n.sendError(conn, msg.ID, fmt.Errorf("%w: malformed file request: %v", ErrBadRequest, err))
+            return
         }
+        n.handleFileRequest(conn, msg.ID, fileName)
+        
+    case ChunkRequestMessage:
+        var request ChunkRequest
+        if err := json.Unmarshal(msg.Data, &request); err != nil {
+            n.sendError(conn, msg.ID, fmt.Errorf("%w: malformed chunk request: %v", ErrBadRequest, err))
+            return
+        }
+        n.handleChunkRequest(conn, msg.ID, request)
+
+    case HaveRequest:
+        var query HaveQuery
+        if err := json.Unmarshal(msg.Data, &query); err != nil {
+            n.sendError(conn, msg.ID, fmt.Errorf("%w: malformed have request: %v", ErrBadRequest, err))
+            return
+        }
+        n.handleHaveRequest(conn, msg.ID, query)
+
+    case DeleteRequest:
+        var fileName string
+        if err := json.Unmarshal(msg.Data, &fileName); err != nil {
+            n.sendError(conn, msg.ID, fmt.Errorf("%w: malformed delete request: %v", ErrBadRequest, err))
+            return
+        }
+        n.handleDeleteRequest(conn, msg.ID, fileName)
+
+    case ListRequest:
+        var dir string
+        if err := json.Unmarshal(msg.Data, &dir); err != nil {
+            n.sendError(conn, msg.ID, fmt.Errorf("%w: malformed list request: %v", ErrBadRequest, err))
+            return
+        }
+        n.handleListRequest(conn, msg.ID, dir)
+
+    default:
+        n.sendError(conn, msg.ID, fmt.Errorf("%w: unexpected %q message", ErrBadRequest, msg.Type))
+    }
+}
+
+// sendError answers a request with an Error message
+func (n *P2PNode) sendError(conn *peerConn, id uint32, err error) {
+    if sendErr := conn.reply(id, newErrorMessage(err)); sendErr != nil {
+        fmt.Printf("Failed to send error response: %v\n", sendErr)
     }
 }
 
 // HandleFileRequest handles file requests
-func (n *P2PNode) handleFileRequest(conn net.Conn, fileName string) {
+func (n *P2PNode) handleFileRequest(conn *peerConn, id uint32, fileName string) {
     // Read metadata
     metadata, err := n.storage.readMetadata(fileName)
     if err != nil {
-        fmt.Printf("Failed to read metadata: %v\n", err)
+        n.sendError(conn, id, err)
         return
     }
 
     // Send metadata response
     response := NewMessage(FileResponse, metadata)
-    if err := sendMessage(conn, response); err != nil {
+    if err := conn.reply(id, response); err != nil {
         fmt.Printf("Failed to send metadata response: %v\n", err)
         return
     }
 }
 
 // HandleChunkRequest handles chunk requests
-func (n *P2PNode) handleChunkRequest(conn net.Conn, request ChunkRequest) {
+func (n *P2PNode) handleChunkRequest(conn *peerConn, id uint32, request ChunkRequest) {
     // Validate hash
     if request.Hash == "" {
-        fmt.Printf("Empty hash in chunk request\n")
+        n.sendError(conn, id, fmt.Errorf("%w: empty hash in chunk request", ErrBadRequest))
         return
     }
 
-    // Read chunk data
-    chunkPath := filepath.Join(n.storage.basePath, request.Hash)
-    chunkData, err := os.ReadFile(chunkPath)
+    // Read and verify chunk data
+    chunk, err := n.storage.readStoredChunk(request.Hash)
     if err != nil {
-        fmt.Printf("Failed to read chunk %s: %v\n", request.Hash, err)
+        n.sendError(conn, id, err)
         return
     }
 
-    // Send chunk response
-    response := NewMessage(FileResponse, ChunkResponse{
-        Hash: request.Hash,
-        Data: chunkData,
-    })
+    // Forward the compressed payload when the requester can decode it
+    chunkResponse := ChunkResponse{Hash: request.Hash, Data: chunk.Data}
+    for _, codec := range request.AcceptCodecs {
+        if chunk.Codec != CodecNone && codec == chunk.Codec {
+            chunkResponse.Data = chunk.Payload
+            chunkResponse.Codec = chunk.Codec
+            break
+        }
+    }
+
+    if request.FileName != "" {
+        proof, err := n.chunkProof(request.FileName, request.Root, request.Index, request.Hash)
+        if err != nil {
+            n.sendError(conn, id, fmt.Errorf("failed to build proof for %s: %w", request.FileName, err))
+            return
+        }
+        chunkResponse.Proof = proof
+    }
+
+    // Send chunk response, with the contents as raw payload
+    response := NewMessage(FileResponse, chunkResponse)
+    response.Payload = chunkResponse.Data
 
-    if err := sendMessage(conn, response); err != nil {
+    if err := conn.reply(id, response); err != nil {
         fmt.Printf("Failed to send chunk response: %v\n", err)
         return
     }
 }
 
-// Update the requestChunk method to handle the response properly
-func (n *P2PNode) requestChunk(peerAddr string, hash string) error {
-    conn, err := net.Dial("tcp", peerAddr)
+// HandleHaveRequest reports which chunks of a file the node holds
+func (n *P2PNode) handleHaveRequest(conn *peerConn, id uint32, query HaveQuery) {
+    var metadata *FileMetadata
+    var err error
+    switch {
+    case query.Root != "":
+        metadata, err = n.storage.FileByRoot(query.Root, query.FileName)
+    case query.FileName != "":
+        metadata, err = n.storage.readMetadata(query.FileName)
+    default:
+        err = fmt.Errorf("%w: have request names no file", ErrBadRequest)
+    }
+    if err != nil {
+        n.sendError(conn, id, err)
+        return
+    }
+
+    result := &HaveResult{Metadata: metadata, Have: make([]byte, (len(metadata.ChunkHashes)+7)/8)}
+    for i, hash := range metadata.ChunkHashes {
+        if has, err := n.storage.chunks.Has(hash); err == nil && has {
+            result.Have[i/8] |= 1 << (i % 8)
+        }
+    }
+
+    response := NewMessage(HaveResponse, result)
+    if err := conn.reply(id, response); err != nil {
+        fmt.Printf("Failed to send have response: %v\n", err)
+        return
+    }
+}
+
+// HandleDeleteRequest deletes a file and reports the released chunks
+func (n *P2PNode) handleDeleteRequest(conn *peerConn, id uint32, fileName string) {
+    if !n.remoteDelete.Load() {
+        n.sendError(conn, id, fmt.Errorf("%w: remote delete is disabled", ErrUnauthorized))
+        return
+    }
+
+    result, err := n.storage.DeleteFile(fileName)
     if err != nil {
-        return fmt.Errorf("failed to connect to peer: %v", err)
+        n.sendError(conn, id, err)
+        return
     }
-    defer conn.Close()
 
-    // Create and send chunk request
-    request := NewMessage("ChunkRequest", ChunkRequest{Hash: hash})
-    if err := sendMessage(conn, request); err != nil {
-        return fmt.Errorf("failed to send chunk request: %v", err)
+    response := NewMessage(DeleteResponse, result)
+    if err := conn.reply(id, response); err != nil {
+        fmt.Printf("Failed to send delete response: %v\n", err)
+        return
     }
+}
 
-    // Receive chunk response
-    response, err := receiveMessage(conn)
+// HandleListRequest sends the listing of a directory
+func (n *P2PNode) handleListRequest(conn *peerConn, id uint32, dir string) {
+    entries, err := n.storage.ListDir(dir)
     if err != nil {
-        return fmt.Errorf("failed to receive chunk response: %v", err)
+        n.sendError(conn, id, err)
+        return
+    }
+    result := &ListResult{Path: dir, Entries: entries}
+
+    response := NewMessage(ListResponse, result)
+    if err := conn.reply(id, response); err != nil {
+        fmt.Printf("Failed to send list response: %v\n", err)
+        return
+    }
+}
+
+// chunkProof proves that hash is the chunk at index of the version of a
+// stored file with the given Merkle root, or of its current version when
+// root is empty
+func (n *P2PNode) chunkProof(fileName, root string, index int, hash string) (*MerkleProof, error) {
+    var metadata *FileMetadata
+    var err error
+    if root != "" {
+        metadata, err = n.storage.FileByRoot(root, fileName)
+    } else {
+        metadata, err = n.storage.readMetadata(fileName)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if index < 0 || index >= len(metadata.ChunkHashes) || metadata.ChunkHashes[index] != hash {
+        return nil, fmt.Errorf("%w: chunk %s is not at index %d", ErrBadRequest, hash, index)
+    }
+    if metadata.MerkleRoot == "" {
+        return nil, fmt.Errorf("%w: no merkle root recorded", ErrBadRequest)
+    }
+
+    n.merkleMutex.Lock()
+    tree, exists := n.merkleTrees[metadata.MerkleRoot]
+    n.merkleMutex.Unlock()
+    if !exists {
+        tree, err = NewMerkleTree(metadata.ChunkHashes)
+        if err != nil {
+            return nil, err
+        }
+        n.merkleMutex.Lock()
+        if len(n.merkleTrees) >= 64 {
+            n.merkleTrees = make(map[string]*MerkleTree)
+        }
+        n.merkleTrees[metadata.MerkleRoot] = tree
+        n.merkleMutex.Unlock()
+    }
+    return tree.Proof(index)
+}
+
+// Update the requestChunk method to handle the response properly
+func (n *P2PNode) requestChunk(peerAddr string, hash string) error {
+    return n.fetchChunk(peerAddr, ChunkRequest{Hash: hash}, nil)
+}
+
+// requestFileChunk fetches the chunk at index of a file and checks it
+// against the file's Merkle root before storing it
+func (n *P2PNode) requestFileChunk(peerAddr string, metadata *FileMetadata, index int) error {
+    request := ChunkRequest{
+        Hash:     metadata.ChunkHashes[index],
+        FileName: metadata.FileName,
+        Index:    index,
+        Root:     metadata.MerkleRoot,
+    }
+    return n.fetchChunk(peerAddr, request, func(response *ChunkResponse) error {
+        proof := response.Proof
+        if proof == nil || proof.Index != index || proof.LeafCount != len(metadata.ChunkHashes) {
+            return &ChunkError{Hash: request.Hash, Err: ErrInvalidProof}
+        }
+        if err := VerifyMerkleProof(metadata.MerkleRoot, response.Hash, proof); err != nil {
+            return &ChunkError{Hash: request.Hash, Err: err}
+        }
+        return nil
+    })
+}
+
+// fetchChunk requests a chunk, verifies it and stores it. verify, when set,
+// runs before the chunk is stored.
+func (n *P2PNode) fetchChunk(peerAddr string, chunkRequest ChunkRequest, verify func(*ChunkResponse) error) error {
+    hash := chunkRequest.Hash
+    // Send chunk request and wait for the response
+    chunkRequest.AcceptCodecs = registeredCodecs()
+    request := NewMessage(ChunkRequestMessage, chunkRequest)
+    response, err := n.connMgr.Request(peerAddr, request)
+    if err != nil {
+        return fmt.Errorf("chunk request failed: %w", err)
     }
 
     // Parse chunk response
@@ -250,6 +607,7 @@ func (n *P2PNode) requestChunk(peerAddr string, hash string) error {
     if err := json.Unmarshal(response.Data, &chunkResponse); err != nil {
         return fmt.Errorf("failed to unmarshal chunk response: %v", err)
     }
+    chunkResponse.Data = response.Payload
 
     // Verify hash matches
     if chunkResponse.Hash != hash {
@@ -257,8 +615,31 @@ func (n *P2PNode) requestChunk(peerAddr string, hash string) error {
             chunkResponse.Hash, hash)
     }
 
-    // Store chunk
-    if err := n.storage.storeChunk(hash, chunkResponse.Data); err != nil {
+    // Verify contents before storing
+    codec := chunkResponse.Codec
+    if codec == "" {
+        codec = CodecNone
+    }
+    data, err := decodePayload(codec, chunkResponse.Data)
+    if err != nil {
+        return fmt.Errorf("failed to decompress chunk %s: %v", hash, err)
+    }
+    if chunkHash(data) != hash {
+        return &ChunkError{Hash: hash, Err: ErrChunkCorrupt}
+    }
+    if verify != nil {
+        if err := verify(&chunkResponse); err != nil {
+            return err
+        }
+    }
+
+    // Store chunk, keeping the compressed form received from the peer
+    if codec != CodecNone {
+        err = n.storage.storeCompressedChunk(hash, codec, chunkResponse.Data)
+    } else {
+        _, err = n.storage.storeChunk(hash, data)
+    }
+    if err != nil {
         return fmt.Errorf("failed to store chunk: %v", err)
     }
 
@@ -266,32 +647,31 @@ func (n *P2PNode) requestChunk(peerAddr string, hash string) error {
 }
 
 func (n *P2PNode) verifyChunk(hash string) error {
-    chunkPath := filepath.Join(n.storage.basePath, hash)
-    _, err := os.Stat(chunkPath)
-    if err != nil {
-        return fmt.Errorf("chunk %s not found: %v", hash, err)
-    }
-    return nil
+    _, err := n.storage.readChunk(hash)
+    return err
 }
 
 // RequestFile requests a file from a peer
 func (n *P2PNode) RequestFile(peerAddr string, fileName string) error {
-    conn, err := net.Dial("tcp", peerAddr)
-    if err != nil {
-        return fmt.Errorf("failed to connect to peer: %v", err)
-    }
-    defer conn.Close()
+    return n.RequestFileWithRoot(peerAddr, fileName, "")
+}
 
-    // Send file request
-    request := NewMessage(FileRequest, fileName)
-    if err := sendMessage(conn, request); err != nil {
-        return fmt.Errorf("failed to send file request: %v", err)
-    }
+// RequestFileWithRoot requests a file from a peer and checks every chunk
+// against a Merkle root obtained from a trusted source. An empty root
+// trusts the root in the peer's metadata.
+func (n *P2PNode) RequestFileWithRoot(peerAddr string, fileName string, expectedRoot string) error {
+    return n.RequestFileWithOptions(peerAddr, fileName, DownloadOptions{ExpectedRoot: expectedRoot})
+}
 
-    // Receive metadata response
-    response, err := receiveMessage(conn)
+// RequestFileWithOptions requests a file from a peer, fetching its chunks
+// concurrently over the pooled connection as opts describes. Once every
+// chunk is stored the metadata is committed as the file's current version.
+func (n *P2PNode) RequestFileWithOptions(peerAddr string, fileName string, opts DownloadOptions) error {
+    // Request the file's metadata
+    request := NewMessage(FileRequest, fileName)
+    response, err := n.connMgr.Request(peerAddr, request)
     if err != nil {
-        return fmt.Errorf("failed to receive metadata response: %v", err)
+        return fmt.Errorf("file request failed: %w", err)
     }
 
     // Parse metadata
@@ -300,13 +680,95 @@ func (n *P2PNode) RequestFile(peerAddr string, fileName string) error {
         return fmt.Errorf("failed to unmarshal metadata: %v", err)
     }
 
-    // Request each chunk using a new connection
-    for _, hash := range metadata.ChunkHashes {
-        if err := n.requestChunk(peerAddr, hash); err != nil {
-            return fmt.Errorf("failed to request chunk %s: %v", hash, err)
+    // The metadata is committed under its own name, which must be the one
+    // asked for
+    if metadata.FileName != fileName {
+        return fmt.Errorf("peer answered a request for %s with metadata for %q", fileName, metadata.FileName)
+    }
+    if opts.ExpectedRoot != "" && metadata.MerkleRoot != opts.ExpectedRoot {
+        return fmt.Errorf("peer has %s with merkle root %q, expected %s", fileName, metadata.MerkleRoot, opts.ExpectedRoot)
+    }
+
+    // Verify each chunk against the root as it arrives. Files stored
+    // before Merkle roots existed can only be checked chunk by chunk.
+    fetch := func(index int) error {
+        return n.requestFileChunk(peerAddr, &metadata, index)
+    }
+    if metadata.MerkleRoot == "" {
+        fetch = func(index int) error {
+            return n.requestChunk(peerAddr, metadata.ChunkHashes[index])
+        }
+    } else {
+        // The chunk list itself must match the root before any proof is
+        // trusted
+        root, err := MerkleRoot(metadata.ChunkHashes)
+        if err != nil {
+            return fmt.Errorf("invalid chunk list: %v", err)
+        }
+        if root != metadata.MerkleRoot {
+            return fmt.Errorf("chunk list of %s doesn't match merkle root %s", fileName, metadata.MerkleRoot)
         }
     }
 
-    return nil
+    // Stored chunks stay out of reach of GC until the commit references them
+    done := n.storage.beginDownload(&metadata)
+    defer done()
+    if err := downloadChunks(&metadata, opts, fetch); err != nil {
+        return err
+    }
+    _, err = n.storage.storeDownloaded(&metadata)
+    return err
 }
 
+// RequestHave asks a peer for a file's metadata and which of its chunks
+// the peer holds
+func (n *P2PNode) RequestHave(peerAddr string, query HaveQuery) (*HaveResult, error) {
+    request := NewMessage(HaveRequest, query)
+    response, err := n.connMgr.Request(peerAddr, request)
+    if err != nil {
+        return nil, fmt.Errorf("have request failed: %w", err)
+    }
+
+    var result HaveResult
+    if err := json.Unmarshal(response.Data, &result); err != nil {
+        return nil, fmt.Errorf("failed to unmarshal have response: %v", err)
+    }
+    if result.Metadata == nil {
+        return nil, fmt.Errorf("have response from %s carries no metadata", peerAddr)
+    }
+
+    return &result, nil
+}
+
+// RequestDelete asks a peer to delete a file
+func (n *P2PNode) RequestDelete(peerAddr string, fileName string) (*DeleteResult, error) {
+    request := NewMessage(DeleteRequest, fileName)
+    response, err := n.connMgr.Request(peerAddr, request)
+    if err != nil {
+        return nil, fmt.Errorf("delete request failed: %w", err)
+    }
+
+    var result DeleteResult
+    if err := json.Unmarshal(response.Data, &result); err != nil {
+        return nil, fmt.Errorf("failed to unmarshal delete response: %v", err)
+    }
+
+    return &result, nil
+}
+
+// RequestList asks a peer for the listing of a directory. The root
+// directory is "".
+func (n *P2PNode) RequestList(peerAddr string, dir string) ([]DirEntry, error) {
+    request := NewMessage(ListRequest, dir)
+    response, err := n.connMgr.Request(peerAddr, request)
+    if err != nil {
+        return nil, fmt.Errorf("list request failed: %w", err)
+    }
+
+    var result ListResult
+    if err := json.Unmarshal(response.Data, &result); err != nil {
+        return nil, fmt.Errorf("failed to unmarshal list response: %v", err)
+    }
+
+    return result.Entries, nil
+}
@@ -3,24 +3,46 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
 
 	"net"
 	"os"
+	"path/filepath"
 
 	"testing"
 	"time"
 )
 
-func TestNetworkBasics(t *testing.T) {
-    // Create and start first node
-    node1, err := NewP2PNode("127.0.0.1:0")
-    if err != nil {
-        t.Fatalf("Failed to create first node: %v", err)
+// startTestNode creates a node on a free port and starts it. Nodes without
+// a RootDir get a temporary one, and every node stops when the test ends.
+func startTestNode(t *testing.T, opts StorageOptions) *P2PNode {
+    t.Helper()
+    node := newTestNode(t, opts)
+    if err := node.Start(); err != nil {
+        t.Fatalf("Failed to start node: %v", err)
     }
-    if err := node1.Start(); err != nil {
-        t.Fatalf("Failed to start first node: %v", err)
+    return node
+}
+
+// newTestNode creates a node that isn't listening, for use as a client
+func newTestNode(t *testing.T, opts StorageOptions) *P2PNode {
+    t.Helper()
+    if opts.RootDir == "" {
+        opts.RootDir = t.TempDir()
+    }
+    node, err := NewP2PNodeWithOptions("127.0.0.1:0", opts)
+    if err != nil {
+        t.Fatalf("Failed to create node: %v", err)
     }
-    defer node1.Stop()
+    t.Cleanup(node.Stop)
+    return node
+}
+
+func TestNetworkBasics(t *testing.T) {
+    // Create and start first node
+    node1 := startTestNode(t, StorageOptions{})
 
     // Get the actual address the node is listening on
     actualAddr := node1.GetListenAddr()
@@ -46,24 +68,8 @@ func TestFileTransfer(t *testing.T) {
     defer os.Remove(testFile)
 
     // Create and start nodes
-    node1, err := NewP2PNode("127.0.0.1:0")
-    if err != nil {
-        t.Fatalf("Failed to create node1: %v", err)
-    }
-    defer node1.Stop()
-
-    node2, err := NewP2PNode("127.0.0.1:0")
-    if err != nil {
-        t.Fatalf("Failed to create node2: %v", err)
-    }
-    defer node2.Stop()
-
-    if err := node1.Start(); err != nil {
-        t.Fatalf("Failed to start node1: %v", err)
-    }
-    if err := node2.Start(); err != nil {
-        t.Fatalf("Failed to start node2: %v", err)
-    }
+    node1 := startTestNode(t, StorageOptions{})
+    node2 := startTestNode(t, StorageOptions{})
 
     t.Logf("Node1 listening on: %s", node1.GetListenAddr())
     t.Logf("Node2 listening on: %s", node2.GetListenAddr())
@@ -82,6 +88,13 @@ func TestFileTransfer(t *testing.T) {
     // Add delay for node readiness
     time.Sleep(100 * time.Millisecond)
 
+    // Nodes have isolated storage, so node2 must not hold the chunks yet
+    for i, hash := range metadata.ChunkHashes {
+        if has, _ := node2.storage.chunks.Has(hash); has {
+            t.Fatalf("Chunk %d already present on node2 before transfer", i)
+        }
+    }
+
     // Request file transfer
     if err := node2.RequestFile(node1.GetListenAddr(), testFile); err != nil {
         t.Fatalf("Failed to request file: %v", err)
@@ -117,6 +130,241 @@ func TestFileTransfer(t *testing.T) {
     }
 }
 
+func TestRemoteDelete(t *testing.T) {
+    node1 := startTestNode(t, StorageOptions{})
+    node2 := newTestNode(t, StorageOptions{})
+
+    if _, err := node1.storage.Ingest(bytes.NewReader([]byte("remote delete")), "remote.txt", IngestOptions{}); err != nil {
+        t.Fatalf("Failed to ingest file: %v", err)
+    }
+
+    // Remote delete is off by default
+    if _, err := node2.RequestDelete(node1.GetListenAddr(), "remote.txt"); !errors.Is(err, ErrUnauthorized) {
+        t.Fatalf("Expected unauthorized, got %v", err)
+    }
+    if _, err := node1.storage.readMetadata("remote.txt"); err != nil {
+        t.Fatalf("File deleted without permission: %v", err)
+    }
+    node1.AllowRemoteDelete(true)
+
+    result, err := node2.RequestDelete(node1.GetListenAddr(), "remote.txt")
+    if err != nil {
+        t.Fatalf("Failed to request delete: %v", err)
+    }
+    if result.ReleasedChunks != 1 {
+        t.Errorf("Expected 1 released chunk, got %d", result.ReleasedChunks)
+    }
+
+    if _, err := node2.RequestDelete(node1.GetListenAddr(), "remote.txt"); err == nil {
+        t.Error("Expected deleting a missing file to fail")
+    }
+}
+
+func TestVerifiedTransfer(t *testing.T) {
+    node1 := startTestNode(t, StorageOptions{ChunkSize: 1024})
+    node2 := newTestNode(t, StorageOptions{})
+
+    content := make([]byte, 5*1024+100)
+    rand.Read(content)
+    metadata, err := node1.storage.Ingest(bytes.NewReader(content), "verified.bin", IngestOptions{})
+    if err != nil {
+        t.Fatalf("Failed to ingest file: %v", err)
+    }
+
+    wrongRoot := chunkHash([]byte("some other file"))
+    if err := node2.RequestFileWithRoot(node1.GetListenAddr(), "verified.bin", wrongRoot); err == nil {
+        t.Error("Expected transfer against the wrong root to fail")
+    }
+    if err := node2.RequestFileWithRoot(node1.GetListenAddr(), "verified.bin", metadata.MerkleRoot); err != nil {
+        t.Fatalf("Failed to request file: %v", err)
+    }
+    for i, hash := range metadata.ChunkHashes {
+        if err := node2.verifyChunk(hash); err != nil {
+            t.Errorf("Chunk %d verification failed: %v", i, err)
+        }
+    }
+
+    // The download is committed, so its chunks are live and fetching it
+    // again adds no version
+    if err := node2.RequestFile(node1.GetListenAddr(), "verified.bin"); err != nil {
+        t.Fatalf("Failed to request file again: %v", err)
+    }
+    local, err := node2.storage.readMetadata("verified.bin")
+    if err != nil || local.MerkleRoot != metadata.MerkleRoot || local.Version != 1 {
+        t.Errorf("Download not committed as version 1: %+v, %v", local, err)
+    }
+    if report, err := node2.storage.CollectGarbage(GCOptions{}); err != nil || len(report.Orphaned) != 0 {
+        t.Errorf("Downloaded chunks collected as garbage: %+v, %v", report, err)
+    }
+
+    // A version stored mid-download doesn't break proofs for the old one
+    if _, err := node1.storage.Ingest(bytes.NewReader([]byte("v2")), "verified.bin", IngestOptions{}); err != nil {
+        t.Fatalf("Failed to ingest new version: %v", err)
+    }
+    if err := node2.requestFileChunk(node1.GetListenAddr(), metadata, 1); err != nil {
+        t.Errorf("Failed to fetch chunk of the old version: %v", err)
+    }
+}
+
+func TestDownloadCommit(t *testing.T) {
+    node1 := startTestNode(t, StorageOptions{ChunkSize: 1024})
+    node2 := newTestNode(t, StorageOptions{})
+
+    content := make([]byte, 16*1024)
+    rand.Read(content)
+    attrs := &FileAttributes{Owner: &FileOwner{UID: 0, User: "root"}, Labels: map[string]string{"kind": "test"}}
+    metadata, err := node1.storage.Ingest(bytes.NewReader(content), "owned.bin", IngestOptions{Attributes: attrs})
+    if err != nil {
+        t.Fatalf("Failed to ingest file: %v", err)
+    }
+
+    // GC started mid-download waits for the commit instead of collecting
+    // the chunks stored so far
+    gcDone := make(chan error, 1)
+    started := false
+    opts := DownloadOptions{
+        Concurrency: 1,
+        Progress: func(DownloadProgress) {
+            if started {
+                return
+            }
+            started = true
+            go func() {
+                _, err := node2.storage.CollectGarbage(GCOptions{})
+                gcDone <- err
+            }()
+            time.Sleep(50 * time.Millisecond)
+        },
+    }
+    if err := node2.RequestFileWithOptions(node1.GetListenAddr(), "owned.bin", opts); err != nil {
+        t.Fatalf("Failed to request file: %v", err)
+    }
+    if err := <-gcDone; err != nil {
+        t.Fatalf("Garbage collection failed: %v", err)
+    }
+    for i, hash := range metadata.ChunkHashes {
+        if err := node2.verifyChunk(hash); err != nil {
+            t.Errorf("Chunk %d lost to garbage collection: %v", i, err)
+        }
+    }
+
+    // The owner names a user on the peer's machine
+    local, err := node2.storage.readMetadata("owned.bin")
+    if err != nil {
+        t.Fatalf("Download not committed: %v", err)
+    }
+    if local.Attributes == nil || local.Attributes.Owner != nil || local.Attributes.Labels["kind"] != "test" {
+        t.Errorf("Unexpected downloaded attributes: %+v", local.Attributes)
+    }
+
+    // A peer can't answer with metadata for a different path, even when it
+    // serves the chunks
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Failed to listen: %v", err)
+    }
+    defer ln.Close()
+    go func() {
+        netConn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        defer netConn.Close()
+        conn, err := acceptPeer(netConn)
+        if err != nil {
+            return
+        }
+        upstream := NewConnectionManager()
+        for {
+            msg, err := conn.receive()
+            if err != nil {
+                return
+            }
+            id := msg.ID
+            if MessageType(msg.Type) == FileRequest {
+                renamed := *metadata
+                renamed.FileName = "elsewhere.bin"
+                conn.reply(id, NewMessage(FileResponse, &renamed))
+                continue
+            }
+            var request ChunkRequest
+            if json.Unmarshal(msg.Data, &request) == nil && request.FileName != "" {
+                request.FileName = metadata.FileName
+                msg = NewMessage(ChunkRequestMessage, request)
+            }
+            if response, err := upstream.Request(node1.GetListenAddr(), msg); err == nil {
+                conn.reply(id, response)
+            }
+        }
+    }()
+    if err := node2.RequestFile(ln.Addr().String(), "owned.bin"); err == nil {
+        t.Error("Expected metadata for another path to be rejected")
+    }
+    if _, err := node2.storage.readMetadata("elsewhere.bin"); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("Metadata committed under the peer's name: %v", err)
+    }
+}
+
+func TestRemoteList(t *testing.T) {
+    node1 := startTestNode(t, StorageOptions{})
+    node2 := newTestNode(t, StorageOptions{})
+
+    if _, err := node1.storage.Ingest(bytes.NewReader([]byte("listed")), "shared/listed.txt", IngestOptions{}); err != nil {
+        t.Fatalf("Failed to ingest file: %v", err)
+    }
+
+    entries, err := node2.RequestList(node1.GetListenAddr(), "shared")
+    if err != nil {
+        t.Fatalf("Failed to request listing: %v", err)
+    }
+    if len(entries) != 1 || entries[0].Path != "shared/listed.txt" || entries[0].Size != 6 {
+        t.Errorf("Unexpected listing: %+v", entries)
+    }
+
+    if _, err := node2.RequestList(node1.GetListenAddr(), "../outside"); err == nil {
+        t.Error("Expected listing an invalid path to fail")
+    }
+}
+
+func TestCompressedTransfer(t *testing.T) {
+    node1 := startTestNode(t, StorageOptions{Compression: CodecGzip})
+    node2 := newTestNode(t, StorageOptions{})
+
+    content := bytes.Repeat([]byte("compressible "), 100000)
+    metadata, err := node1.storage.Ingest(bytes.NewReader(content), "text.txt", IngestOptions{})
+    if err != nil {
+        t.Fatalf("Failed to ingest file: %v", err)
+    }
+
+    if err := node2.RequestFile(node1.GetListenAddr(), "text.txt"); err != nil {
+        t.Fatalf("Failed to request file: %v", err)
+    }
+
+    // node2 keeps the compressed form it received
+    for _, hash := range metadata.ChunkHashes {
+        codec, err := node2.storage.chunkCodec(hash)
+        if err != nil {
+            t.Fatalf("Chunk %s missing on node2: %v", hash, err)
+        }
+        if codec != CodecGzip {
+            t.Errorf("Expected chunk %s stored as gzip, got %s", hash, codec)
+        }
+    }
+
+    reader, err := node2.storage.OpenMetadata(metadata)
+    if err != nil {
+        t.Fatalf("Failed to open file: %v", err)
+    }
+    defer reader.Close()
+    received, err := io.ReadAll(reader)
+    if err != nil {
+        t.Fatalf("Failed to read file: %v", err)
+    }
+    if !bytes.Equal(received, content) {
+        t.Error("Transferred content doesn't match original")
+    }
+}
+
 func TestConnectionManager(t *testing.T) {
 	cm := NewConnectionManager()
 
@@ -144,4 +392,243 @@ func TestConnectionManager(t *testing.T) {
 	if c := cm.GetConnection(conn.RemoteAddr().String()); c != nil {
 		t.Error("Connection still exists after removal")
 	}
-}
\ No newline at end of file
+}
+
+func TestScrubberRefetchesFromPeers(t *testing.T) {
+    node1 := startTestNode(t, StorageOptions{ChunkSize: 1024})
+    node2 := newTestNode(t, StorageOptions{ChunkSize: 1024})
+
+    content := make([]byte, 3*1024)
+    rand.Read(content)
+    var metadata *FileMetadata
+    var err error
+    for _, node := range []*P2PNode{node1, node2} {
+        if metadata, err = node.storage.Ingest(bytes.NewReader(content), "scrubbed.bin", IngestOptions{}); err != nil {
+            t.Fatalf("Failed to ingest file: %v", err)
+        }
+    }
+    bad := metadata.ChunkHashes[1]
+    if err := node2.storage.chunks.Put(bad, []byte("bit rot")); err != nil {
+        t.Fatalf("Failed to corrupt chunk: %v", err)
+    }
+
+    node2.AddPeer("127.0.0.1:1") // unreachable, tried first
+    node2.AddPeer(node1.GetListenAddr())
+    scrubber := node2.StartScrubber(time.Hour, 0)
+
+    deadline := time.Now().Add(5 * time.Second)
+    for scrubber.LastReport() == nil && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    report := scrubber.LastReport()
+    if report == nil {
+        t.Fatal("Scrub pass did not finish")
+    }
+    if len(report.Corrupt) != 1 || len(report.Repaired) != 1 || len(report.Failed) != 0 {
+        t.Errorf("Unexpected scrub report: %+v", report)
+    }
+    if err := node2.verifyChunk(bad); err != nil {
+        t.Errorf("Chunk not re-fetched: %v", err)
+    }
+}
+
+func TestJSONWireTransfer(t *testing.T) {
+    node1 := startTestNode(t, StorageOptions{ChunkSize: 1024})
+    node2 := newTestNode(t, StorageOptions{})
+    node2.UseJSONWire(true)
+
+    content := make([]byte, 3*1024+7)
+    rand.Read(content)
+    metadata, err := node1.storage.Ingest(bytes.NewReader(content), "debug.bin", IngestOptions{})
+    if err != nil {
+        t.Fatalf("Failed to ingest file: %v", err)
+    }
+    if err := node2.RequestFile(node1.GetListenAddr(), "debug.bin"); err != nil {
+        t.Fatalf("Failed to request file over JSON: %v", err)
+    }
+    for i, hash := range metadata.ChunkHashes {
+        if err := node2.verifyChunk(hash); err != nil {
+            t.Errorf("Chunk %d verification failed: %v", i, err)
+        }
+    }
+}
+
+func TestErrorResponses(t *testing.T) {
+    node1 := startTestNode(t, StorageOptions{})
+    node2 := newTestNode(t, StorageOptions{})
+    addr := node1.GetListenAddr()
+
+    // Errors arrive as responses instead of read timeouts
+    start := time.Now()
+    err := node2.RequestFile(addr, "missing.txt")
+    var peerErr *PeerError
+    if !errors.As(err, &peerErr) || peerErr.Code != CodeNotFound || !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("Expected not_found for a missing file, got %v", err)
+    }
+    if err := node2.requestChunk(addr, chunkHash([]byte("absent"))); !errors.Is(err, ErrChunkNotFound) {
+        t.Errorf("Expected not_found for a missing chunk, got %v", err)
+    }
+    if _, err := node2.RequestList(addr, "../up"); !errors.Is(err, ErrBadRequest) {
+        t.Errorf("Expected bad_request for an invalid path, got %v", err)
+    }
+    if _, err := node2.RequestDelete(addr, "missing.txt"); !errors.Is(err, ErrUnauthorized) {
+        t.Errorf("Expected unauthorized deleting without permission, got %v", err)
+    }
+    node1.AllowRemoteDelete(true)
+    if _, err := node2.RequestDelete(addr, "missing.txt"); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("Expected not_found deleting a missing file, got %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > 2*time.Second {
+        t.Errorf("Error responses took %v", elapsed)
+    }
+
+    // node2's pooled connection takes the only slot, so a third client is
+    // answered busy
+    node1.SetMaxConnections(1)
+    node3 := newP2PClient(node2.storage)
+    defer node3.connMgr.CloseAll()
+    if _, err := node3.RequestList(addr, ""); !errors.Is(err, ErrBusy) {
+        t.Errorf("Expected busy, got %v", err)
+    }
+    if _, err := node2.RequestList(addr, ""); err != nil {
+        t.Errorf("Pooled connection refused: %v", err)
+    }
+}
+
+func TestMultiplexedRequests(t *testing.T) {
+    node1 := startTestNode(t, StorageOptions{ChunkSize: 1024})
+    node2 := newTestNode(t, StorageOptions{})
+
+    content := make([]byte, 20*1024)
+    rand.Read(content)
+    metadata, err := node1.storage.Ingest(bytes.NewReader(content), "pooled.bin", IngestOptions{})
+    if err != nil {
+        t.Fatalf("Failed to ingest file: %v", err)
+    }
+    addr := node1.GetListenAddr()
+
+    // Many outstanding requests share one connection
+    errs := make(chan error, len(metadata.ChunkHashes))
+    for _, hash := range metadata.ChunkHashes {
+        go func(hash string) {
+            errs <- node2.requestChunk(addr, hash)
+        }(hash)
+    }
+    for range metadata.ChunkHashes {
+        if err := <-errs; err != nil {
+            t.Errorf("Concurrent chunk request failed: %v", err)
+        }
+    }
+    if err := node2.RequestFile(addr, "pooled.bin"); err != nil {
+        t.Fatalf("Failed to request file: %v", err)
+    }
+
+    node1.connMgr.mu.RLock()
+    accepted := len(node1.connMgr.connections)
+    node1.connMgr.mu.RUnlock()
+    if accepted != 1 {
+        t.Errorf("Expected one pooled connection, node1 accepted %d", accepted)
+    }
+}
+
+func TestRequestRetry(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Failed to listen: %v", err)
+    }
+    defer ln.Close()
+
+    // The peer answers the first request on each connection and drops the
+    // connection on the second
+    deletes := make(chan struct{}, 4)
+    go func() {
+        for {
+            netConn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer netConn.Close()
+                conn, err := acceptPeer(netConn)
+                if err != nil {
+                    return
+                }
+                for served := 0; ; served++ {
+                    msg, err := conn.receive()
+                    if err != nil {
+                        return
+                    }
+                    if MessageType(msg.Type) == DeleteRequest {
+                        deletes <- struct{}{}
+                    }
+                    if served > 0 {
+                        return
+                    }
+                    conn.reply(msg.ID, NewMessage(Pong, nil))
+                }
+            }()
+        }
+    }()
+    addr := ln.Addr().String()
+    cm := NewConnectionManager()
+
+    // A delete that may have reached the peer is not sent again
+    if _, err := cm.Request(addr, NewMessage(Ping, nil)); err != nil {
+        t.Fatalf("Ping failed: %v", err)
+    }
+    if _, err := cm.Request(addr, NewMessage(DeleteRequest, "a.txt")); !errors.Is(err, errSessionClosed) {
+        t.Errorf("Expected the delete to fail, got %v", err)
+    }
+    if len(deletes) != 1 {
+        t.Errorf("Delete sent %d times", len(deletes))
+    }
+
+    // A read-only request is retried on a new connection
+    if _, err := cm.Request(addr, NewMessage(Ping, nil)); err != nil {
+        t.Fatalf("Ping failed: %v", err)
+    }
+    if _, err := cm.Request(addr, NewMessage(ListRequest, "")); err != nil {
+        t.Errorf("Expected the list request to be retried, got %v", err)
+    }
+}
+
+func TestConcurrentFileDownload(t *testing.T) {
+    node1 := startTestNode(t, StorageOptions{ChunkSize: 1024})
+    node2 := newTestNode(t, StorageOptions{})
+
+    content := make([]byte, 100*1024+17)
+    rand.Read(content)
+    metadata, err := node1.storage.Ingest(bytes.NewReader(content), "window.bin", IngestOptions{})
+    if err != nil {
+        t.Fatalf("Failed to ingest file: %v", err)
+    }
+
+    var last DownloadProgress
+    reports := 0
+    opts := DownloadOptions{
+        ExpectedRoot: metadata.MerkleRoot,
+        Concurrency:  16,
+        Progress: func(p DownloadProgress) {
+            reports++
+            last = p
+        },
+    }
+    if err := node2.RequestFileWithOptions(node1.GetListenAddr(), "window.bin", opts); err != nil {
+        t.Fatalf("Failed to request file: %v", err)
+    }
+    if reports != len(metadata.ChunkHashes) || last.BytesDone != int64(len(content)) {
+        t.Errorf("Unexpected progress: %d reports, last %+v", reports, last)
+    }
+
+    outputPath := filepath.Join(t.TempDir(), "window.bin")
+    if err := node2.storage.ReassembleFile(metadata, outputPath); err != nil {
+        t.Fatalf("Failed to reassemble file: %v", err)
+    }
+    received, err := os.ReadFile(outputPath)
+    if err != nil {
+        t.Fatalf("Failed to read reassembled file: %v", err)
+    }
+    if !bytes.Equal(received, content) {
+        t.Error("Reassembled content doesn't match original")
+    }
+}
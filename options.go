@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DefaultFilePerm is used for chunk and metadata files
+	DefaultFilePerm os.FileMode = 0644
+	// DefaultDirPerm is used for storage directories
+	DefaultDirPerm os.FileMode = 0755
+)
+
+// StorageOptions configures a StorageEngine. Zero values fall back to the
+// package defaults, so StorageOptions{} behaves like NewStorageEngine().
+type StorageOptions struct {
+	// RootDir, when set, holds the storage, metadata and state directories
+	// unless they are given explicitly
+	RootDir     string
+	StorageDir  string
+	MetadataDir string
+	// StateDir holds engine bookkeeping such as quarantined chunks
+	StateDir string
+
+	// ChunkSize is the fixed chunk size used when Chunking is not set
+	ChunkSize int
+	// Chunking selects the chunking algorithm; zero means fixed ChunkSize
+	Chunking ChunkingParams
+	// Compression names the codec new chunks are stored with
+	Compression string
+	// Encryption selects how new files are encrypted at rest
+	Encryption string
+	// Keyring holds encryption keys; defaults to a keyring file in StateDir
+	Keyring Keyring
+
+	FilePerm os.FileMode
+	DirPerm  os.FileMode
+
+	// ChunkStore overrides the filesystem store under StorageDir
+	ChunkStore ChunkStore
+
+	// NodeID is recorded as the author of new file versions; defaults to
+	// the host name
+	NodeID string
+
+	// VerifyOnStartup re-hashes every chunk during startup recovery, which
+	// takes time in proportion to the data stored. Leftover temporary files
+	// are always removed, and the scrubber finds corruption in the
+	// background.
+	VerifyOnStartup bool
+}
+
+// withDefaults returns a copy of the options with every unset field filled in
+func (o StorageOptions) withDefaults() StorageOptions {
+	if o.StorageDir == "" {
+		o.StorageDir = StorageDir
+		if o.RootDir != "" {
+			o.StorageDir = filepath.Join(o.RootDir, "storage")
+		}
+	}
+	if o.MetadataDir == "" {
+		o.MetadataDir = MetadataDir
+		if o.RootDir != "" {
+			o.MetadataDir = filepath.Join(o.RootDir, "metadata")
+		}
+	}
+	if o.StateDir == "" {
+		o.StateDir = StateDir
+		if o.RootDir != "" {
+			o.StateDir = filepath.Join(o.RootDir, "state")
+		}
+	}
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = ChunkSize
+	}
+	if o.Chunking.Algorithm == "" {
+		o.Chunking = FixedChunking(o.ChunkSize)
+	}
+	if o.Compression == "" {
+		o.Compression = CodecNone
+	}
+	if o.Encryption == "" {
+		o.Encryption = EncryptionNone
+	}
+	if o.Keyring == nil {
+		o.Keyring = NewLocalKeyring(filepath.Join(o.StateDir, "keyring.json"))
+	}
+	if o.NodeID == "" {
+		o.NodeID, _ = os.Hostname()
+	}
+	if o.FilePerm == 0 {
+		o.FilePerm = DefaultFilePerm
+	}
+	if o.DirPerm == 0 {
+		o.DirPerm = DefaultDirPerm
+	}
+	return o
+}
@@ -18,12 +18,34 @@ const (
     FileRequest MessageType = "file_request"
     // FileResponse represents a file response message
     FileResponse MessageType = "file_response"
+    // DeleteRequest asks a peer to delete a file
+    DeleteRequest MessageType = "delete_request"
+    // DeleteResponse reports the outcome of a delete request
+    DeleteResponse MessageType = "delete_response"
+    // ListRequest asks a peer for a directory listing
+    ListRequest MessageType = "list_request"
+    // ListResponse carries a directory listing
+    ListResponse MessageType = "list_response"
+    // HaveRequest asks a peer which chunks of a file it holds
+    HaveRequest MessageType = "have_request"
+    // HaveResponse carries the file's metadata and the chunks held
+    HaveResponse MessageType = "have_response"
+    // ChunkRequestMessage carries a ChunkRequest
+    ChunkRequestMessage MessageType = "ChunkRequest"
+    // ErrorMessage carries an ErrorResponse in place of the expected
+    // response
+    ErrorMessage MessageType = "error"
 )
 
 // Message represents a basic message
 type Message struct {
     Type string      `json:"type"`
+    // ID pairs a response with its request
+    ID   uint32      `json:"id,omitempty"`
     Data json.RawMessage `json:"data"`
+    // Payload carries raw bytes such as chunk contents outside of Data,
+    // so the binary protocol sends them unencoded
+    Payload []byte `json:"payload,omitempty"`
 }
 
 // NewMessage creates a new message
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Codes of Error messages
+const (
+	CodeNotFound     = "not_found"
+	CodeCorrupt      = "corrupt"
+	CodeBusy         = "busy"
+	CodeUnauthorized = "unauthorized"
+	CodeBadRequest   = "bad_request"
+	// CodeInternal covers failures the requester can do nothing about,
+	// such as I/O errors
+	CodeInternal = "internal"
+)
+
+var (
+	// ErrBusy is returned when a node is too loaded to serve a request
+	ErrBusy = errors.New("busy")
+	// ErrUnauthorized is returned when a node refuses a request
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrBadRequest is returned for malformed or invalid requests
+	ErrBadRequest = errors.New("bad request")
+)
+
+// ErrorResponse is the body of an Error message
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PeerError is returned when a peer answers a request with an Error
+// message. It matches the local errors for its code with errors.Is, so
+// checks for os.ErrNotExist, ErrChunkNotFound, ErrChunkCorrupt, ErrBusy,
+// ErrUnauthorized and ErrBadRequest work across the network.
+type PeerError struct {
+	Peer    string
+	Code    string
+	Message string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer %s: %s: %s", e.Peer, e.Code, e.Message)
+}
+
+func (e *PeerError) Unwrap() []error {
+	switch e.Code {
+	case CodeNotFound:
+		return []error{os.ErrNotExist, ErrChunkNotFound}
+	case CodeCorrupt:
+		return []error{ErrChunkCorrupt}
+	case CodeBusy:
+		return []error{ErrBusy}
+	case CodeUnauthorized:
+		return []error{ErrUnauthorized}
+	case CodeBadRequest:
+		return []error{ErrBadRequest}
+	}
+	return nil
+}
+
+// errorCode classifies a local error for an Error message
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrChunkNotFound):
+		return CodeNotFound
+	case errors.Is(err, ErrChunkCorrupt):
+		return CodeCorrupt
+	case errors.Is(err, ErrBusy):
+		return CodeBusy
+	case errors.Is(err, ErrUnauthorized):
+		return CodeUnauthorized
+	case errors.Is(err, ErrBadRequest), errors.Is(err, ErrInvalidHash), errors.Is(err, ErrInvalidName),
+		errors.Is(err, ErrIsDirectory), errors.Is(err, ErrNotDirectory):
+		return CodeBadRequest
+	}
+	return CodeInternal
+}
+
+// newErrorMessage builds the Error message reporting err
+func newErrorMessage(err error) *Message {
+	return NewMessage(ErrorMessage, ErrorResponse{Code: errorCode(err), Message: err.Error()})
+}
+
+// peerError decodes an Error message from peerAddr
+func peerError(peerAddr string, msg *Message) error {
+	var response ErrorResponse
+	if err := json.Unmarshal(msg.Data, &response); err != nil {
+		return fmt.Errorf("failed to unmarshal error from peer %s: %v", peerAddr, err)
+	}
+	return &PeerError{Peer: peerAddr, Code: response.Code, Message: response.Message}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// FileReader streams a stored file chunk by chunk. Chunks are loaded and
+// verified lazily, so only one chunk is held in memory at a time.
+type FileReader struct {
+	metadata *FileMetadata
+	chunks   *fileChunks
+	offsets  []int64 // start offset of each chunk within the file
+	pos      int64
+
+	chunkIndex int // index of the cached chunk, -1 when nothing is cached
+	chunk      []byte
+	closed     bool
+}
+
+// Open returns a reader over the stored file with the given name
+func (se *StorageEngine) Open(fileName string) (*FileReader, error) {
+	metadata, err := se.readMetadata(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return se.OpenMetadata(metadata)
+}
+
+// OpenMetadata returns a reader over the file described by metadata
+func (se *StorageEngine) OpenMetadata(metadata *FileMetadata) (*FileReader, error) {
+	if len(metadata.ChunkHashes) != len(metadata.ChunkSizes) {
+		return nil, fmt.Errorf("metadata for %s lists %d hashes but %d sizes",
+			metadata.FileName, len(metadata.ChunkHashes), len(metadata.ChunkSizes))
+	}
+
+	offsets := make([]int64, len(metadata.ChunkSizes))
+	var total int64
+	for i, size := range metadata.ChunkSizes {
+		offsets[i] = total
+		total += size
+	}
+	if total != metadata.TotalSize {
+		return nil, fmt.Errorf("metadata for %s has chunk sizes summing to %d, expected %d",
+			metadata.FileName, total, metadata.TotalSize)
+	}
+
+	chunks, err := se.fileChunks(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileReader{
+		metadata:   metadata,
+		chunks:     chunks,
+		offsets:    offsets,
+		chunkIndex: -1,
+	}, nil
+}
+
+// Metadata returns the metadata of the file being read
+func (fr *FileReader) Metadata() *FileMetadata {
+	return fr.metadata
+}
+
+// Size returns the total size of the file
+func (fr *FileReader) Size() int64 {
+	return fr.metadata.TotalSize
+}
+
+// Read implements io.Reader
+func (fr *FileReader) Read(p []byte) (int, error) {
+	if fr.closed {
+		return 0, os.ErrClosed
+	}
+	if fr.pos >= fr.metadata.TotalSize {
+		return 0, io.EOF
+	}
+
+	// Find the last chunk starting at or before pos
+	index := sort.Search(len(fr.offsets), func(i int) bool {
+		return fr.offsets[i] > fr.pos
+	}) - 1
+
+	if err := fr.loadChunk(index); err != nil {
+		return 0, err
+	}
+
+	n := copy(p, fr.chunk[fr.pos-fr.offsets[index]:])
+	fr.pos += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker
+func (fr *FileReader) Seek(offset int64, whence int) (int64, error) {
+	if fr.closed {
+		return 0, os.ErrClosed
+	}
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = fr.pos + offset
+	case io.SeekEnd:
+		pos = fr.metadata.TotalSize + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	fr.pos = pos
+	return pos, nil
+}
+
+// Close releases the cached chunk
+func (fr *FileReader) Close() error {
+	if fr.closed {
+		return os.ErrClosed
+	}
+	fr.closed = true
+	fr.chunk = nil
+	return nil
+}
+
+// loadChunk reads and verifies the chunk at index unless it is cached
+func (fr *FileReader) loadChunk(index int) error {
+	if index == fr.chunkIndex {
+		return nil
+	}
+
+	data, err := fr.chunks.read(index)
+	if err != nil {
+		return fmt.Errorf("failed to read chunk: %w", err)
+	}
+
+	fr.chunkIndex = index
+	fr.chunk = data
+	return nil
+}
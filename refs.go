@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DeleteResult describes the outcome of deleting a file
+type DeleteResult struct {
+	FileName       string `json:"fileName"`
+	ReleasedChunks int    `json:"releasedChunks"`
+	ReleasedBytes  int64  `json:"releasedBytes"`
+}
+
+// refCounts maps chunk hashes to the number of file versions using them
+type refCounts map[string]int
+
+func (se *StorageEngine) refsPath() string {
+	return filepath.Join(se.statePath, "refcounts.json")
+}
+
+// loadRefs returns the reference count table, rebuilding it from metadata
+// when the engine has none yet. Callers must hold refMu.
+func (se *StorageEngine) loadRefs() (refCounts, error) {
+	if se.refs != nil {
+		return se.refs, nil
+	}
+
+	data, err := os.ReadFile(se.refsPath())
+	if os.IsNotExist(err) {
+		return se.rebuildRefs()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reference counts: %v", err)
+	}
+
+	refs := make(refCounts)
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reference counts: %v", err)
+	}
+	se.refs = refs
+	return refs, nil
+}
+
+// rebuildRefs recounts references from every stored file version.
+// Callers must hold refMu.
+func (se *StorageEngine) rebuildRefs() (refCounts, error) {
+	all, err := se.allVersionDocs()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(refCounts)
+	for _, metadata := range all {
+		for hash := range uniqueChunks(metadata) {
+			refs[hash]++
+		}
+	}
+	if err := se.saveRefs(refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// saveRefs persists the reference count table. Callers must hold refMu.
+func (se *StorageEngine) saveRefs(refs refCounts) error {
+	data, err := json.Marshal(refs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reference counts: %v", err)
+	}
+	if err := os.MkdirAll(se.statePath, se.dirPerm); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	if err := writeFileAtomic(se.refsPath(), data, se.filePerm); err != nil {
+		return fmt.Errorf("failed to write reference counts: %v", err)
+	}
+	se.refs = refs
+	return nil
+}
+
+// uniqueChunks returns the distinct chunk hashes of a file
+func uniqueChunks(metadata *FileMetadata) map[string]bool {
+	hashes := make(map[string]bool, len(metadata.ChunkHashes))
+	for _, hash := range metadata.ChunkHashes {
+		hashes[hash] = true
+	}
+	return hashes
+}
+
+// pinChunk protects a chunk written by an ingest that has not committed
+// its metadata yet from being released
+func (se *StorageEngine) pinChunk(hash string) {
+	se.refMu.Lock()
+	defer se.refMu.Unlock()
+	if se.pins == nil {
+		se.pins = make(map[string]int)
+	}
+	se.pins[hash]++
+}
+
+// unpinChunks drops the pins taken by pinChunk
+func (se *StorageEngine) unpinChunks(hashes []string) {
+	se.refMu.Lock()
+	defer se.refMu.Unlock()
+	for _, hash := range hashes {
+		se.pins[hash]--
+		if se.pins[hash] <= 0 {
+			delete(se.pins, hash)
+		}
+	}
+}
+
+// discardChunks deletes chunks written by an ingest that failed, except
+// those another ingest has pinned or a file references. Callers must have
+// dropped their own pins. Chunks that cannot be checked are left for
+// garbage collection.
+func (se *StorageEngine) discardChunks(hashes []string) {
+	se.refMu.Lock()
+	defer se.refMu.Unlock()
+
+	refs, err := se.loadRefs()
+	if err != nil {
+		return
+	}
+	for _, hash := range hashes {
+		if se.pins[hash] > 0 || refs[hash] > 0 {
+			continue
+		}
+		se.chunks.Delete(hash)
+	}
+}
+
+// commitMetadata stores metadata as a new version of its file, makes it
+// the current version and takes references on its chunks. Earlier versions
+// keep their references until the file is deleted.
+func (se *StorageEngine) commitMetadata(metadata *FileMetadata) error {
+	se.refMu.Lock()
+	defer se.refMu.Unlock()
+
+	refs, err := se.loadRefs()
+	if err != nil {
+		return err
+	}
+
+	err = se.meta.update(func(tx *bolt.Tx) error {
+		if err := checkFilePath(tx, metadata.FileName); err != nil {
+			return err
+		}
+		if err := ensureDir(tx, path.Dir(metadata.FileName)); err != nil {
+			return err
+		}
+		version, err := nextVersion(tx, metadata.FileName)
+		if err != nil {
+			return err
+		}
+		metadata.Version = version
+		if err := putVersion(tx, metadata); err != nil {
+			return fmt.Errorf("failed to store version: %v", err)
+		}
+		if err := putFile(tx, metadata); err != nil {
+			return fmt.Errorf("failed to store metadata: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for hash := range uniqueChunks(metadata) {
+		refs[hash]++
+	}
+	return se.saveRefs(refs)
+}
+
+// beginDownload keeps the chunks of a file being downloaded from garbage
+// collection and from being released until the returned function is
+// called, which must happen after storeDownloaded
+func (se *StorageEngine) beginDownload(metadata *FileMetadata) func() {
+	se.gcMu.RLock()
+	for _, hash := range metadata.ChunkHashes {
+		se.pinChunk(hash)
+	}
+	return func() {
+		se.unpinChunks(metadata.ChunkHashes)
+		se.gcMu.RUnlock()
+	}
+}
+
+// storeDownloaded commits metadata fetched from a peer, once all its
+// chunks are stored, as the current version of the file so the chunks are
+// referenced. A file whose current version already has the same Merkle
+// root is left as it is. The peer's record of the owner is dropped, since
+// it names a user on another machine.
+func (se *StorageEngine) storeDownloaded(remote *FileMetadata) (*FileMetadata, error) {
+	if err := validateFileName(remote.FileName); err != nil {
+		return nil, err
+	}
+	for _, hash := range remote.ChunkHashes {
+		if _, err := se.chunks.Stat(hash); err != nil {
+			return nil, &ChunkError{Hash: hash, Err: fmt.Errorf("%w: not stored after download", ErrChunkNotFound)}
+		}
+	}
+	current, err := se.readMetadata(remote.FileName)
+	if err == nil && remote.MerkleRoot != "" && current.MerkleRoot == remote.MerkleRoot {
+		return current, nil
+	}
+
+	metadata := *remote
+	if remote.Attributes != nil {
+		metadata.Attributes = remote.Attributes.clone()
+		metadata.Attributes.Owner = nil
+	}
+	if err := se.commitMetadata(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to store metadata for %s: %w", remote.FileName, err)
+	}
+	return &metadata, nil
+}
+
+// DeleteFile removes a file and its history and releases chunks no other
+// file version references
+func (se *StorageEngine) DeleteFile(fileName string) (*DeleteResult, error) {
+	if err := validateFileName(fileName); err != nil {
+		return nil, err
+	}
+
+	se.refMu.Lock()
+	defer se.refMu.Unlock()
+
+	refs, err := se.loadRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []*FileMetadata
+	err = se.meta.update(func(tx *bolt.Tx) error {
+		var err error
+		versions, err = removeFile(tx, fileName)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DeleteResult{FileName: fileName}
+	for _, metadata := range versions {
+		released, releasedBytes, err := se.releaseChunks(refs, metadata)
+		if err != nil {
+			return nil, err
+		}
+		result.ReleasedChunks += released
+		result.ReleasedBytes += releasedBytes
+	}
+	if err := se.saveRefs(refs); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// releaseChunks drops one reference to each chunk of metadata and deletes
+// chunks whose count falls to zero
+func (se *StorageEngine) releaseChunks(refs refCounts, metadata *FileMetadata) (int, int64, error) {
+	var released int
+	var releasedBytes int64
+	for hash := range uniqueChunks(metadata) {
+		refs[hash]--
+		if refs[hash] > 0 {
+			continue
+		}
+		delete(refs, hash)
+
+		// An ingest in progress is about to reference this chunk
+		if se.pins[hash] > 0 {
+			continue
+		}
+
+		info, err := se.chunks.Stat(hash)
+		if err != nil {
+			// Already gone, nothing to release
+			continue
+		}
+		if err := se.chunks.Delete(hash); err != nil {
+			return released, releasedBytes, &ChunkError{Hash: hash, Err: err}
+		}
+		released++
+		releasedBytes += info.Size
+	}
+	return released, releasedBytes, nil
+}
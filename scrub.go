@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errScrubStopped ends a scrub pass interrupted by Scrubber.Stop
+var errScrubStopped = errors.New("scrub stopped")
+
+// ScrubOptions controls a scrub pass
+type ScrubOptions struct {
+	// BytesPerSecond limits how fast stored chunks are read; zero means
+	// no limit
+	BytesPerSecond int64
+	// Repair, when set, fetches a good copy of each corrupt chunk that
+	// files still reference
+	Repair ChunkFetcher
+	// OnReport is called with the report of every background pass
+	OnReport func(*ScrubReport)
+}
+
+// ScrubReport summarises a scrub pass
+type ScrubReport struct {
+	StartedAt     time.Time `json:"startedAt"`
+	FinishedAt    time.Time `json:"finishedAt"`
+	ChunksChecked int       `json:"chunksChecked"`
+	BytesChecked  int64     `json:"bytesChecked"`
+	// Corrupt lists chunks whose contents did not match their hash; they
+	// were moved to quarantine
+	Corrupt []string `json:"corrupt,omitempty"`
+	// Affected lists the files using corrupt chunks
+	Affected []string `json:"affected,omitempty"`
+	Repaired []string `json:"repaired,omitempty"`
+	// Failed maps corrupt chunks that could not be repaired to the reason
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// Scrub re-hashes every stored chunk, quarantines mismatches and, when
+// opts.Repair is set, replaces them with good copies
+func (se *StorageEngine) Scrub(opts ScrubOptions) (*ScrubReport, error) {
+	return se.scrub(opts, nil)
+}
+
+func (se *StorageEngine) scrub(opts ScrubOptions, stop <-chan struct{}) (*ScrubReport, error) {
+	report := &ScrubReport{StartedAt: time.Now(), Failed: make(map[string]string)}
+	hashes, err := se.chunks.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %v", err)
+	}
+	sort.Strings(hashes)
+
+	affected := make(map[string]bool)
+	for _, hash := range hashes {
+		stored, err := se.chunks.Get(hash)
+		if errors.Is(err, ErrChunkNotFound) {
+			// Collected since the listing
+			continue
+		}
+		if err != nil {
+			return nil, &ChunkError{Hash: hash, Err: err}
+		}
+		report.ChunksChecked++
+		report.BytesChecked += int64(len(stored))
+
+		if _, err := decodeStoredChunk(hash, stored); err != nil {
+			files, err := se.quarantineIfCorrupt(hash)
+			if err != nil {
+				return nil, err
+			}
+			if files != nil {
+				report.Corrupt = append(report.Corrupt, hash)
+				for _, name := range files {
+					affected[name] = true
+				}
+				if len(files) > 0 && opts.Repair != nil {
+					if err := se.refetchChunk(hash, opts.Repair); err != nil {
+						report.Failed[hash] = err.Error()
+					} else {
+						report.Repaired = append(report.Repaired, hash)
+					}
+				}
+			}
+		}
+
+		if err := throttle(report.StartedAt, report.BytesChecked, opts.BytesPerSecond, stop); err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range affected {
+		report.Affected = append(report.Affected, name)
+	}
+	sort.Strings(report.Affected)
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// quarantineIfCorrupt checks a chunk again with garbage collection and
+// ingests excluded, so a chunk rewritten in the meantime is left alone. For
+// a corrupt chunk it returns the files using it, empty but not nil when
+// there are none.
+func (se *StorageEngine) quarantineIfCorrupt(hash string) ([]string, error) {
+	se.gcMu.Lock()
+	defer se.gcMu.Unlock()
+
+	if _, err := se.readChunk(hash); !errors.Is(err, ErrChunkCorrupt) {
+		return nil, nil
+	}
+	if err := se.quarantineCorruptChunk(hash); err != nil {
+		return nil, err
+	}
+	files, err := se.FilesWithChunk(hash)
+	if files == nil {
+		files = []string{}
+	}
+	return files, err
+}
+
+// refetchChunk fetches a chunk and verifies the stored copy
+func (se *StorageEngine) refetchChunk(hash string, fetch ChunkFetcher) error {
+	if err := fetch(hash); err != nil {
+		return err
+	}
+	_, err := se.readChunk(hash)
+	return err
+}
+
+// throttle sleeps until reading checked bytes since start fits within
+// bytesPerSecond. It returns errScrubStopped if stop closes first.
+func throttle(start time.Time, checked, bytesPerSecond int64, stop <-chan struct{}) error {
+	var wait time.Duration
+	if bytesPerSecond > 0 {
+		due := time.Duration(float64(checked) / float64(bytesPerSecond) * float64(time.Second))
+		wait = due - time.Since(start)
+	}
+	if wait <= 0 {
+		select {
+		case <-stop:
+			return errScrubStopped
+		default:
+			return nil
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return errScrubStopped
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Scrubber runs scrub passes in the background
+type Scrubber struct {
+	engine   *StorageEngine
+	opts     ScrubOptions
+	interval time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mu   sync.Mutex
+	last *ScrubReport
+}
+
+// StartScrubber scrubs the engine's chunks every interval until stopped.
+// The first pass starts immediately.
+func (se *StorageEngine) StartScrubber(interval time.Duration, opts ScrubOptions) *Scrubber {
+	s := &Scrubber{
+		engine:   se,
+		opts:     opts,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Scrubber) run() {
+	defer close(s.done)
+
+	for {
+		report, err := s.engine.scrub(s.opts, s.stop)
+		if errors.Is(err, errScrubStopped) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Scrub failed: %v\n", err)
+		} else {
+			s.mu.Lock()
+			s.last = report
+			s.mu.Unlock()
+			if len(report.Corrupt) > 0 {
+				fmt.Printf("Scrub checked %d chunks: %d corrupt, %d repaired, %d files affected\n",
+					report.ChunksChecked, len(report.Corrupt), len(report.Repaired), len(report.Affected))
+			}
+			if s.opts.OnReport != nil {
+				s.opts.OnReport(report)
+			}
+		}
+
+		timer := time.NewTimer(s.interval)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// LastReport returns the report of the last completed pass, or nil
+func (s *Scrubber) LastReport() *ScrubReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Stop interrupts the current pass and waits for the scrubber to exit
+func (s *Scrubber) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
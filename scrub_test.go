@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+	engine := newTestEngine(t)
+	source := newTestEngine(t)
+
+	data := append(bytes.Repeat([]byte("a"), 1024), bytes.Repeat([]byte("b"), 1024)...)
+	for _, e := range []*StorageEngine{engine, source} {
+		if _, err := e.Ingest(bytes.NewReader(data), "data.bin", IngestOptions{}); err != nil {
+			t.Fatalf("Failed to ingest: %v", err)
+		}
+	}
+	bad := chunkHash(bytes.Repeat([]byte("b"), 1024))
+	engine.chunks.Put(bad, []byte("bit rot"))
+	// A corrupt chunk no file uses is quarantined but not fetched
+	orphan := chunkHash([]byte("orphan"))
+	engine.chunks.Put(orphan, []byte("garbage"))
+
+	var fetched []string
+	report, err := engine.Scrub(ScrubOptions{
+		Repair: func(hash string) error {
+			fetched = append(fetched, hash)
+			data, err := source.readChunk(hash)
+			if err != nil {
+				return err
+			}
+			_, err = engine.storeChunk(hash, data)
+			return err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if report.ChunksChecked != 3 || len(report.Corrupt) != 2 {
+		t.Errorf("Unexpected scrub report: %+v", report)
+	}
+	if len(fetched) != 1 || fetched[0] != bad || len(report.Repaired) != 1 {
+		t.Errorf("Expected only %s to be fetched, got %v", bad, fetched)
+	}
+	if len(report.Affected) != 1 || report.Affected[0] != "data.bin" {
+		t.Errorf("Unexpected affected files: %v", report.Affected)
+	}
+	if _, err := engine.readChunk(bad); err != nil {
+		t.Errorf("Chunk not repaired: %v", err)
+	}
+	if has, _ := engine.chunks.Has(orphan); has {
+		t.Error("Corrupt orphan chunk not quarantined")
+	}
+}
+
+func TestScrubRateLimit(t *testing.T) {
+	engine := newTestEngine(t)
+	if _, err := engine.Ingest(bytes.NewReader(make([]byte, 4096)), "zeros", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		engine.Ingest(bytes.NewReader(bytes.Repeat([]byte{byte(i + 1)}, 1024)), "file", IngestOptions{})
+	}
+
+	// Five 1 KiB chunks at 10 KiB/s take at least 0.4s after the first
+	start := time.Now()
+	report, err := engine.Scrub(ScrubOptions{BytesPerSecond: 10 * 1024})
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if report.ChunksChecked != 5 {
+		t.Errorf("Expected 5 chunks checked, got %d", report.ChunksChecked)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Scrub not rate limited, took %v", elapsed)
+	}
+
+	// Stopping interrupts a slow pass
+	scrubber := engine.StartScrubber(time.Hour, ScrubOptions{BytesPerSecond: 1})
+	start = time.Now()
+	scrubber.Stop()
+	if time.Since(start) > time.Second || scrubber.LastReport() != nil {
+		t.Error("Stop did not interrupt the pass")
+	}
+}
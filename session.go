@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sessionIdleTimeout closes pooled connections unused for this long.
+	// Servers wait serverIdleTimeout, so clients normally close first.
+	sessionIdleTimeout = time.Minute
+	serverIdleTimeout  = 2 * time.Minute
+	// maxInflightRequests bounds the requests a node serves concurrently
+	// on one connection
+	maxInflightRequests = 32
+)
+
+// errSessionClosed is returned for requests on a session whose connection
+// has failed or been closed
+var errSessionClosed = errors.New("connection closed")
+
+// peerSession multiplexes requests over one connection to a peer. Each
+// request carries a fresh ID and responses are matched back by ID, so many
+// requests can be outstanding at once.
+type peerSession struct {
+	conn   *peerConn
+	peer   string
+	nextID atomic.Uint32
+
+	mu      sync.Mutex
+	pending map[uint32]chan *Message
+	err     error
+	done    chan struct{}
+}
+
+func newPeerSession(conn *peerConn, peer string) *peerSession {
+	conn.readTimeout = sessionIdleTimeout
+	s := &peerSession{
+		conn:    conn,
+		peer:    peer,
+		pending: make(map[uint32]chan *Message),
+		done:    make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// readLoop hands each response to the request waiting for it
+func (s *peerSession) readLoop() {
+	for {
+		msg, err := s.conn.receive()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		s.mu.Lock()
+		ch := s.pending[msg.ID]
+		delete(s.pending, msg.ID)
+		s.mu.Unlock()
+		// Responses to requests that timed out are dropped
+		if ch != nil {
+			ch <- msg
+		}
+	}
+}
+
+// fail closes the session, failing every outstanding request
+func (s *peerSession) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = fmt.Errorf("%w: %v", errSessionClosed, err)
+	close(s.done)
+	s.conn.Close()
+}
+
+func (s *peerSession) close() {
+	s.fail(fmt.Errorf("session closed"))
+}
+
+func (s *peerSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// roundTrip sends msg under a new request ID and waits for its response.
+// An Error message in reply is returned as a *PeerError.
+func (s *peerSession) roundTrip(msg *Message) (*Message, error) {
+	id := s.nextID.Add(1)
+	msg.ID = id
+	ch := make(chan *Message, 1)
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.pending[id] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+	}()
+
+	if err := s.conn.send(msg); err != nil {
+		s.fail(err)
+		return nil, fmt.Errorf("%w: %v", errSessionClosed, err)
+	}
+
+	timer := time.NewTimer(wireTimeout)
+	defer timer.Stop()
+	select {
+	case response := <-ch:
+		if MessageType(response.Type) == ErrorMessage {
+			return nil, peerError(s.peer, response)
+		}
+		return response, nil
+	case <-s.done:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return nil, s.err
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out waiting for response to request %d", id)
+	}
+}
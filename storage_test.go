@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestEngine(t *testing.T) *StorageEngine {
+	t.Helper()
+	engine, err := NewStorageEngineWithOptions(StorageOptions{
+		RootDir:    t.TempDir(),
+		ChunkSize:  1024,
+		ChunkStore: NewMemoryChunkStore(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	return engine
+}
+
+func TestIngestFromReader(t *testing.T) {
+	engine, err := NewStorageEngineWithOptions(StorageOptions{RootDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+
+	data := make([]byte, ChunkSize+512)
+	rand.Read(data)
+	sum := sha256.Sum256(data)
+
+	metadata, err := engine.Ingest(bytes.NewReader(data), "ingest_test.bin", IngestOptions{
+		ExpectedSize: int64(len(data)),
+		ExpectedHash: hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		t.Fatalf("Failed to ingest stream: %v", err)
+	}
+
+	if metadata.TotalSize != int64(len(data)) {
+		t.Errorf("Expected total size %d, got %d", len(data), metadata.TotalSize)
+	}
+	if len(metadata.ChunkHashes) != 2 {
+		t.Errorf("Expected 2 chunks, got %d", len(metadata.ChunkHashes))
+	}
+
+	stored, err := engine.readMetadata("ingest_test.bin")
+	if err != nil {
+		t.Fatalf("Failed to read stored metadata: %v", err)
+	}
+	if stored.TotalSize != metadata.TotalSize {
+		t.Errorf("Stored metadata size %d doesn't match %d", stored.TotalSize, metadata.TotalSize)
+	}
+}
+
+func TestIngestRejectsMismatch(t *testing.T) {
+	engine, err := NewStorageEngineWithOptions(StorageOptions{RootDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+
+	data := []byte("some streamed content")
+	if _, err := engine.Ingest(bytes.NewReader(data), "mismatch.txt", IngestOptions{ExpectedSize: 3}); err == nil {
+		t.Error("Expected size mismatch to be rejected")
+	}
+	if _, err := engine.Ingest(bytes.NewReader(data), "mismatch.txt", IngestOptions{ExpectedHash: "00"}); err == nil {
+		t.Error("Expected hash mismatch to be rejected")
+	}
+	if _, err := engine.readMetadata("mismatch.txt"); err == nil {
+		t.Error("Metadata should not be stored for a rejected stream")
+	}
+	if has, _ := engine.chunks.Has(chunkHash(data)); has {
+		t.Error("Chunks of a rejected stream should be deleted")
+	}
+	// Chunks a stored file references survive a rejected stream
+	if _, err := engine.Ingest(bytes.NewReader(data), "kept.txt", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if _, err := engine.Ingest(bytes.NewReader(data), "mismatch.txt", IngestOptions{ExpectedSize: 3}); err == nil {
+		t.Error("Expected size mismatch to be rejected")
+	}
+	if has, _ := engine.chunks.Has(chunkHash(data)); !has {
+		t.Error("Referenced chunk deleted with a rejected stream")
+	}
+	if _, err := engine.Ingest(bytes.NewReader(data), "../escape", IngestOptions{}); err == nil {
+		t.Error("Expected invalid name to be rejected")
+	}
+}
+
+func TestFileReaderSeek(t *testing.T) {
+	engine, err := NewStorageEngineWithOptions(StorageOptions{RootDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+
+	data := make([]byte, 2*ChunkSize+100)
+	rand.Read(data)
+	_, err = engine.Ingest(bytes.NewReader(data), "reader_test.bin", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest stream: %v", err)
+	}
+
+	reader, err := engine.Open("reader_test.bin")
+	if err != nil {
+		t.Fatalf("Failed to open stored file: %v", err)
+	}
+	defer reader.Close()
+
+	// Read a range spanning the first chunk boundary
+	start := int64(ChunkSize - 10)
+	if _, err := reader.Seek(start, io.SeekStart); err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatalf("Failed to read range: %v", err)
+	}
+	if !bytes.Equal(buf, data[start:start+20]) {
+		t.Error("Range read across chunk boundary doesn't match original")
+	}
+
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	all, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read whole file: %v", err)
+	}
+	if !bytes.Equal(all, data) {
+		t.Error("Streamed content doesn't match original")
+	}
+}
+
+func TestReadChunkErrors(t *testing.T) {
+	engine := newTestEngine(t)
+
+	missing := sha256.Sum256([]byte("never stored"))
+	if _, err := engine.readChunk(hex.EncodeToString(missing[:])); !errors.Is(err, ErrChunkNotFound) {
+		t.Errorf("Expected ErrChunkNotFound, got %v", err)
+	}
+
+	if _, err := engine.readChunk("../metadata/example.txt.json"); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("Expected ErrInvalidHash, got %v", err)
+	}
+
+	sum := sha256.Sum256([]byte("original contents"))
+	hash := hex.EncodeToString(sum[:])
+	if err := engine.chunks.Put(hash, []byte("tampered contents")); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	defer engine.chunks.Delete(hash)
+
+	_, err := engine.readChunk(hash)
+	if !errors.Is(err, ErrChunkCorrupt) {
+		t.Errorf("Expected ErrChunkCorrupt, got %v", err)
+	}
+	var chunkErr *ChunkError
+	if !errors.As(err, &chunkErr) || chunkErr.Hash != hash {
+		t.Errorf("Expected ChunkError for %s, got %v", hash, err)
+	}
+}
+
+func TestStartupRecovery(t *testing.T) {
+	root := t.TempDir()
+	engine, err := NewStorageEngineWithOptions(StorageOptions{RootDir: root})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	if _, err := engine.Ingest(bytes.NewReader([]byte("good chunk")), "good.txt", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	// Simulate a crash mid-write and a chunk truncated under its hash name
+	storageDir := filepath.Join(root, "storage")
+	leftover := filepath.Join(storageDir, ".abc"+tempMarker+"123")
+	if err := os.WriteFile(leftover, []byte("partial"), 0644); err != nil {
+		t.Fatalf("Failed to write leftover: %v", err)
+	}
+	sum := sha256.Sum256([]byte("full contents"))
+	truncated := hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(storageDir, truncated), []byte("full"), 0644); err != nil {
+		t.Fatalf("Failed to write truncated chunk: %v", err)
+	}
+
+	engine, err = NewStorageEngineWithOptions(StorageOptions{RootDir: root, VerifyOnStartup: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen storage engine: %v", err)
+	}
+	report, err := engine.Recover(true)
+	if err != nil {
+		t.Fatalf("Recovery failed: %v", err)
+	}
+	if report.ChunksChecked != 1 {
+		t.Errorf("Expected only the good chunk to remain, checked %d", report.ChunksChecked)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("Temporary file survived recovery")
+	}
+	if _, err := os.Stat(filepath.Join(root, "state", "quarantine", "corrupt", truncated)); err != nil {
+		t.Errorf("Truncated chunk was not quarantined: %v", err)
+	}
+	if _, err := engine.Open("good.txt"); err != nil {
+		t.Errorf("Good file unreadable after recovery: %v", err)
+	}
+}
+
+func TestIngestDeduplicates(t *testing.T) {
+	engine := newTestEngine(t)
+
+	data := append(bytes.Repeat([]byte("a"), 1024), bytes.Repeat([]byte("b"), 1024)...)
+	first, err := engine.Ingest(bytes.NewReader(data), "first.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if first.Stats.NewChunks != 2 || first.Stats.NewBytes != 2048 || first.Stats.DedupChunks != 0 {
+		t.Errorf("Unexpected stats for first ingest: %+v", first.Stats)
+	}
+
+	// Repeats the first chunk within the file and shares both with first.txt
+	data = append(data, bytes.Repeat([]byte("a"), 1024)...)
+	second, err := engine.Ingest(bytes.NewReader(data), "second.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if second.Stats.NewChunks != 0 || second.Stats.DedupChunks != 3 || second.Stats.DedupBytes != 3072 {
+		t.Errorf("Unexpected stats for second ingest: %+v", second.Stats)
+	}
+}
+
+func TestIngestReplacesCorruptChunk(t *testing.T) {
+	engine := newTestEngine(t)
+
+	data := bytes.Repeat([]byte("c"), 1024)
+	if _, err := engine.Ingest(bytes.NewReader(data), "first.txt", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	hash := chunkHash(data)
+	if err := engine.chunks.Put(hash, []byte("bit rot")); err != nil {
+		t.Fatalf("Failed to corrupt chunk: %v", err)
+	}
+
+	second, err := engine.Ingest(bytes.NewReader(data), "second.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Ingest over a corrupt chunk failed: %v", err)
+	}
+	if second.Stats.NewChunks != 1 {
+		t.Errorf("Expected the chunk to be rewritten: %+v", second.Stats)
+	}
+	if _, err := engine.readChunk(hash); err != nil {
+		t.Errorf("Chunk still unreadable: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(engine.quarantinePath(), "corrupt", hash)); err != nil {
+		t.Errorf("Corrupt copy was not quarantined: %v", err)
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSwarmPerPeer      = 4
+	defaultSwarmStallTimeout = 5 * time.Second
+	// maxPeerFailures is how many chunk requests in a row a peer may fail
+	// before a swarm download stops using it
+	maxPeerFailures = 3
+)
+
+// SwarmOptions controls a download from several peers
+type SwarmOptions struct {
+	// Peers to download from; defaults to the node's known peers
+	Peers []string
+	// Concurrency bounds the chunk requests in flight across all peers
+	Concurrency int
+	// PerPeer bounds the chunk requests in flight to one peer
+	PerPeer int
+	// StallTimeout is how long a chunk request may run before the chunk is
+	// requested from another holder too. The stalled peer gets no new
+	// requests until it answers.
+	StallTimeout time.Duration
+	// Progress is called after each chunk is stored, as for DownloadOptions
+	Progress func(DownloadProgress)
+}
+
+func (o SwarmOptions) withDefaults() SwarmOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultDownloadConcurrency
+	}
+	if o.PerPeer <= 0 {
+		o.PerPeer = defaultSwarmPerPeer
+	}
+	if o.StallTimeout <= 0 {
+		o.StallTimeout = defaultSwarmStallTimeout
+	}
+	return o
+}
+
+// SwarmResult reports a finished swarm download
+type SwarmResult struct {
+	// Metadata is the downloaded version as committed locally
+	Metadata *FileMetadata
+	// Chunks maps each peer to the number of chunks it provided
+	Chunks map[string]int
+	// Dropped maps peers left out of the download, or dropped during it,
+	// to the reason
+	Dropped map[string]string
+}
+
+// SwarmFile downloads the current version of a file, spreading chunk
+// requests over every peer that holds it, and commits its metadata
+func (n *P2PNode) SwarmFile(fileName string, opts SwarmOptions) (*SwarmResult, error) {
+	return n.swarm(HaveQuery{FileName: fileName}, opts)
+}
+
+// SwarmRoot downloads the file with a Merkle root, spreading chunk
+// requests over every peer that holds it, and commits its metadata
+func (n *P2PNode) SwarmRoot(root string, opts SwarmOptions) (*SwarmResult, error) {
+	return n.swarm(HaveQuery{Root: root}, opts)
+}
+
+func (n *P2PNode) swarm(query HaveQuery, opts SwarmOptions) (*SwarmResult, error) {
+	opts = opts.withDefaults()
+	if len(opts.Peers) == 0 {
+		opts.Peers = n.Peers()
+	}
+	if len(opts.Peers) == 0 {
+		return nil, fmt.Errorf("no peers to download from")
+	}
+
+	result := &SwarmResult{Chunks: make(map[string]int), Dropped: make(map[string]string)}
+	metadata, peers, err := n.discover(query, opts.Peers, result)
+	if err != nil {
+		return nil, err
+	}
+	result.Metadata = metadata
+
+	// Stored chunks stay out of reach of GC until the commit references them
+	done := n.storage.beginDownload(metadata)
+	defer done()
+	s := newSwarmScheduler(n, metadata, peers, opts, result)
+	if err := s.run(); err != nil {
+		return nil, err
+	}
+	if result.Metadata, err = n.storage.storeDownloaded(metadata); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type haveAnswer struct {
+	peer   string
+	result *HaveResult
+	err    error
+}
+
+// discover asks every peer which chunks of the file it holds and settles
+// on one version: the one named by the query's root, or else the one most
+// peers hold, newest first. Peers that fail or hold another version are
+// recorded in result.Dropped.
+func (n *P2PNode) discover(query HaveQuery, addrs []string, result *SwarmResult) (*FileMetadata, []*swarmPeer, error) {
+	answers := make([]haveAnswer, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			have, err := n.RequestHave(addr, query)
+			answers[i] = haveAnswer{peer: addr, result: have, err: err}
+		}(i, addr)
+	}
+	wg.Wait()
+
+	// Group the answers by Merkle root, checking each chunk list once
+	holders := make(map[string][]haveAnswer)
+	valid := make(map[string]bool)
+	for _, answer := range answers {
+		if answer.err != nil {
+			result.Dropped[answer.peer] = answer.err.Error()
+			continue
+		}
+		metadata := answer.result.Metadata
+		root := metadata.MerkleRoot
+		if root == "" {
+			result.Dropped[answer.peer] = "file has no merkle root"
+			continue
+		}
+		if query.Root != "" && root != query.Root {
+			result.Dropped[answer.peer] = fmt.Sprintf("answered with merkle root %s", root)
+			continue
+		}
+		if query.FileName != "" && metadata.FileName != query.FileName {
+			result.Dropped[answer.peer] = fmt.Sprintf("answered with metadata for %q", metadata.FileName)
+			continue
+		}
+		if _, checked := valid[root]; !checked {
+			computed, err := MerkleRoot(metadata.ChunkHashes)
+			valid[root] = err == nil && computed == root && len(metadata.ChunkSizes) == len(metadata.ChunkHashes)
+		}
+		if !valid[root] {
+			result.Dropped[answer.peer] = fmt.Sprintf("chunk list doesn't match merkle root %s", root)
+			continue
+		}
+		holders[root] = append(holders[root], answer)
+	}
+
+	var best string
+	for root, answers := range holders {
+		if best == "" || len(answers) > len(holders[best]) ||
+			(len(answers) == len(holders[best]) && newerThan(answers[0].result.Metadata, holders[best][0].result.Metadata)) {
+			best = root
+		}
+	}
+	if best == "" {
+		name := query.FileName
+		if name == "" {
+			name = query.Root
+		}
+		return nil, nil, fmt.Errorf("no peer holds %s: %w", name, ErrChunkNotFound)
+	}
+
+	var peers []*swarmPeer
+	for root, answers := range holders {
+		for _, answer := range answers {
+			if root != best {
+				result.Dropped[answer.peer] = fmt.Sprintf("holds another version with merkle root %s", root)
+				continue
+			}
+			peers = append(peers, &swarmPeer{addr: answer.peer, have: answer.result})
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].addr < peers[j].addr })
+	return holders[best][0].result.Metadata, peers, nil
+}
+
+// newerThan orders versions by creation time, then by root so the choice
+// does not depend on map order
+func newerThan(a, b *FileMetadata) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.MerkleRoot > b.MerkleRoot
+}
+
+// swarmPeer tracks one source of a swarm download
+type swarmPeer struct {
+	addr string
+	have *HaveResult
+	// inflight counts requests not yet answered, stalled ones included
+	inflight int
+	stalled  int
+	failures int
+	dropped  bool
+	// served and elapsed time the peer's successful requests
+	served  int
+	elapsed time.Duration
+}
+
+// usable reports whether the peer can take another request now
+func (p *swarmPeer) usable(perPeer int) bool {
+	return !p.dropped && p.stalled == 0 && p.inflight < perPeer
+}
+
+// wait estimates how long one more request to the peer would take. Peers
+// not yet measured come first, so every peer gets tried.
+func (p *swarmPeer) wait() time.Duration {
+	if p.served == 0 {
+		return 0
+	}
+	return p.elapsed / time.Duration(p.served) * time.Duration(p.inflight+1)
+}
+
+// swarmChunk tracks one chunk of a swarm download
+type swarmChunk struct {
+	index   int
+	holders []*swarmPeer
+	// tried holds the peers asked for the chunk, which are not asked again
+	tried    map[*swarmPeer]bool
+	inflight int
+	// active counts requests in flight that have not stalled
+	active  int
+	queued  bool
+	done    bool
+	lastErr error
+}
+
+// swarmRequest is one chunk request to one peer
+type swarmRequest struct {
+	chunk    *swarmChunk
+	peer     *swarmPeer
+	started  time.Time
+	timer    *time.Timer
+	stalled  bool
+	finished bool
+	err      error
+}
+
+// swarmScheduler assigns chunks to peers. Only its run goroutine touches
+// the scheduling state; requests report back over channels.
+type swarmScheduler struct {
+	n        *P2PNode
+	opts     SwarmOptions
+	metadata *FileMetadata
+	peers    []*swarmPeer
+	chunks   []*swarmChunk
+	// pending holds chunks waiting for a peer, rarest first once sorted
+	pending []*swarmChunk
+	sorted  bool
+	// active counts requests in flight that have not stalled
+	active      int
+	outstanding int
+	results     chan *swarmRequest
+	stalls      chan *swarmRequest
+	// done closes when run returns, releasing abandoned requests
+	done     chan struct{}
+	progress DownloadProgress
+	result   *SwarmResult
+	err      error
+}
+
+func newSwarmScheduler(n *P2PNode, metadata *FileMetadata, peers []*swarmPeer, opts SwarmOptions, result *SwarmResult) *swarmScheduler {
+	s := &swarmScheduler{
+		n:        n,
+		opts:     opts,
+		metadata: metadata,
+		peers:    peers,
+		results:  make(chan *swarmRequest),
+		stalls:   make(chan *swarmRequest),
+		done:     make(chan struct{}),
+		progress: DownloadProgress{FileName: metadata.FileName, ChunksTotal: len(metadata.ChunkHashes)},
+		result:   result,
+	}
+	for i := range metadata.ChunkHashes {
+		c := &swarmChunk{index: i, tried: make(map[*swarmPeer]bool), queued: true}
+		for _, p := range peers {
+			if p.have.Holds(i) {
+				c.holders = append(c.holders, p)
+			}
+		}
+		s.chunks = append(s.chunks, c)
+		s.pending = append(s.pending, c)
+		s.progress.BytesTotal += metadata.ChunkSizes[i]
+	}
+	return s
+}
+
+// run downloads every chunk, returning once all are stored or one cannot
+// be had from any peer. Requests still outstanding then are abandoned.
+func (s *swarmScheduler) run() error {
+	defer close(s.done)
+	for _, c := range s.chunks {
+		if len(c.holders) == 0 {
+			return fmt.Errorf("no peer holds chunk %d (%s) of %s", c.index, s.metadata.ChunkHashes[c.index], s.metadata.FileName)
+		}
+	}
+
+	for s.progress.ChunksDone < s.progress.ChunksTotal {
+		s.dispatch()
+		if s.err != nil {
+			return s.err
+		}
+		if s.outstanding == 0 {
+			return fmt.Errorf("no peer can provide the remaining %d chunks of %s",
+				s.progress.ChunksTotal-s.progress.ChunksDone, s.metadata.FileName)
+		}
+
+		select {
+		case req := <-s.results:
+			s.complete(req)
+		case req := <-s.stalls:
+			s.stall(req)
+		}
+		if s.err != nil {
+			return s.err
+		}
+	}
+	return nil
+}
+
+// dispatch starts requests for pending chunks, rarest first, until the
+// concurrency limit is reached or no pending chunk has a usable holder
+func (s *swarmScheduler) dispatch() {
+	if !s.sorted {
+		sort.SliceStable(s.pending, func(i, j int) bool {
+			a, b := s.pending[i], s.pending[j]
+			if ra, rb := s.rarity(a), s.rarity(b); ra != rb {
+				return ra < rb
+			}
+			return a.index < b.index
+		})
+		s.sorted = true
+	}
+
+	for s.active < s.opts.Concurrency {
+		started := false
+		for i, c := range s.pending {
+			if peer := s.pick(c); peer != nil {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				c.queued = false
+				s.start(c, peer)
+				started = true
+				break
+			}
+		}
+		if !started {
+			return
+		}
+	}
+}
+
+// rarity counts the peers still able to provide a chunk
+func (s *swarmScheduler) rarity(c *swarmChunk) int {
+	count := 0
+	for _, p := range c.holders {
+		if !p.dropped {
+			count++
+		}
+	}
+	return count
+}
+
+// pick returns the usable holder of a chunk expected to answer soonest
+func (s *swarmScheduler) pick(c *swarmChunk) *swarmPeer {
+	var best *swarmPeer
+	for _, p := range c.holders {
+		if c.tried[p] || !p.usable(s.opts.PerPeer) {
+			continue
+		}
+		if best == nil || p.wait() < best.wait() {
+			best = p
+		}
+	}
+	return best
+}
+
+// available reports whether some holder not yet tried may still provide
+// a chunk, now or once it has capacity
+func (s *swarmScheduler) available(c *swarmChunk) bool {
+	for _, p := range c.holders {
+		if !p.dropped && !c.tried[p] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *swarmScheduler) start(c *swarmChunk, p *swarmPeer) {
+	c.tried[p] = true
+	c.inflight++
+	c.active++
+	p.inflight++
+	s.active++
+	s.outstanding++
+
+	req := &swarmRequest{chunk: c, peer: p, started: time.Now()}
+	req.timer = time.AfterFunc(s.opts.StallTimeout, func() {
+		select {
+		case s.stalls <- req:
+		case <-s.done:
+		}
+	})
+	hash := s.metadata.ChunkHashes[c.index]
+	go func() {
+		req.err = s.n.requestChunk(p.addr, hash)
+		select {
+		case s.results <- req:
+		case <-s.done:
+		}
+	}()
+}
+
+func (s *swarmScheduler) complete(req *swarmRequest) {
+	req.finished = true
+	req.timer.Stop()
+	c, p := req.chunk, req.peer
+	c.inflight--
+	p.inflight--
+	s.outstanding--
+	if req.stalled {
+		p.stalled--
+	} else {
+		c.active--
+		s.active--
+	}
+
+	if req.err == nil {
+		p.failures = 0
+		p.served++
+		p.elapsed += time.Since(req.started)
+		if !c.done {
+			s.finish(c, p)
+		}
+		return
+	}
+
+	c.lastErr = req.err
+	p.failures++
+	// Errors the peer answered with leave the connection usable; anything
+	// else, such as a dead connection or a corrupt chunk, drops the peer
+	var peerErr *PeerError
+	if !errors.As(req.err, &peerErr) || p.failures >= maxPeerFailures {
+		s.drop(p, req.err)
+	}
+	if !c.done && c.active == 0 {
+		s.requeue(c)
+	}
+}
+
+// stall asks another holder for a chunk whose request is overdue, leaving
+// the slow request running in case it still completes first
+func (s *swarmScheduler) stall(req *swarmRequest) {
+	if req.finished || req.chunk.done {
+		return
+	}
+	req.stalled = true
+	req.peer.stalled++
+	req.chunk.active--
+	s.active--
+	if req.chunk.active == 0 {
+		s.requeue(req.chunk)
+	}
+}
+
+func (s *swarmScheduler) finish(c *swarmChunk, p *swarmPeer) {
+	c.done = true
+	if c.queued {
+		for i, pending := range s.pending {
+			if pending == c {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				break
+			}
+		}
+		c.queued = false
+	}
+
+	s.result.Chunks[p.addr]++
+	s.progress.Chunk = c.index
+	s.progress.ChunksDone++
+	s.progress.BytesDone += s.metadata.ChunkSizes[c.index]
+	if s.opts.Progress != nil {
+		s.opts.Progress(s.progress)
+	}
+}
+
+// requeue puts a chunk with no active request back to be requested from
+// another holder. With none left, the download fails unless a stalled
+// request for the chunk may still complete.
+func (s *swarmScheduler) requeue(c *swarmChunk) {
+	if !s.available(c) {
+		if c.inflight == 0 {
+			s.fail(c)
+		}
+		return
+	}
+	if !c.queued {
+		s.enqueue(c)
+	}
+}
+
+func (s *swarmScheduler) fail(c *swarmChunk) {
+	if s.err == nil {
+		s.err = fmt.Errorf("no peer could provide chunk %d (%s) of %s, last error: %w",
+			c.index, s.metadata.ChunkHashes[c.index], s.metadata.FileName, c.lastErr)
+	}
+}
+
+func (s *swarmScheduler) enqueue(c *swarmChunk) {
+	c.queued = true
+	s.pending = append(s.pending, c)
+	s.sorted = false
+}
+
+// drop stops using a peer. Chunks only it could still provide fail the
+// download unless a request for them is outstanding.
+func (s *swarmScheduler) drop(p *swarmPeer, err error) {
+	if p.dropped {
+		return
+	}
+	p.dropped = true
+	s.result.Dropped[p.addr] = err.Error()
+	s.sorted = false
+
+	for _, c := range s.chunks {
+		if !c.done && c.inflight == 0 && !s.available(c) {
+			if c.lastErr == nil {
+				c.lastErr = err
+			}
+			s.fail(c)
+		}
+	}
+}
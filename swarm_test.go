@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startSwarmSource starts a node holding content as name
+func startSwarmSource(t *testing.T, name string, content []byte) *P2PNode {
+	t.Helper()
+	node := startTestNode(t, StorageOptions{ChunkSize: 1024})
+	if _, err := node.storage.Ingest(bytes.NewReader(content), name, IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest file: %v", err)
+	}
+	return node
+}
+
+// startStallingPeer answers have requests with have but never answers a
+// chunk request
+func startStallingPeer(t *testing.T, have *HaveResult) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			netConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer netConn.Close()
+				conn, err := acceptPeer(netConn)
+				if err != nil {
+					return
+				}
+				for {
+					msg, err := conn.receive()
+					if err != nil {
+						return
+					}
+					if MessageType(msg.Type) == HaveRequest {
+						conn.reply(msg.ID, NewMessage(HaveResponse, have))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSwarmDownload(t *testing.T) {
+	content := make([]byte, 32*1024)
+	rand.Read(content)
+
+	full := startSwarmSource(t, "swarm.bin", content)
+	// front and back each lack a quarter of the chunks, which only full
+	// and the other one hold
+	front := startSwarmSource(t, "swarm.bin", content)
+	back := startSwarmSource(t, "swarm.bin", content)
+	// corrupt claims every chunk but serves a corrupt copy of some
+	corrupt := startSwarmSource(t, "swarm.bin", content)
+	// other holds a different version
+	other := startSwarmSource(t, "swarm.bin", []byte("something else"))
+
+	metadata, err := full.storage.readMetadata("swarm.bin")
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	for i, hash := range metadata.ChunkHashes {
+		switch {
+		case i < 8:
+			back.storage.chunks.Delete(hash)
+		case i >= 24:
+			front.storage.chunks.Delete(hash)
+		case i < 16:
+			corrupt.storage.chunks.Put(hash, []byte("bit rot"))
+		}
+	}
+
+	have := &HaveResult{Metadata: metadata, Have: bytes.Repeat([]byte{0xff}, 4)}
+	stalling := startStallingPeer(t, have)
+	// renamed answers with the same version under another name
+	renamedMetadata := *metadata
+	renamedMetadata.FileName = "elsewhere.bin"
+	renamed := startStallingPeer(t, &HaveResult{Metadata: &renamedMetadata, Have: have.Have})
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	client := newTestNode(t, StorageOptions{})
+	for _, node := range []*P2PNode{full, front, back, corrupt, other} {
+		client.AddPeer(node.GetListenAddr())
+	}
+	client.AddPeer(stalling)
+	client.AddPeer(renamed)
+	client.AddPeer(deadAddr)
+
+	// GC started mid-download waits for the commit
+	gcDone := make(chan error, 1)
+	reports := 0
+	began := time.Now()
+	result, err := client.SwarmFile("swarm.bin", SwarmOptions{
+		StallTimeout: 100 * time.Millisecond,
+		Progress: func(DownloadProgress) {
+			reports++
+			if reports == 1 {
+				go func() {
+					_, err := client.storage.CollectGarbage(GCOptions{})
+					gcDone <- err
+				}()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Swarm download failed: %v", err)
+	}
+	if err := <-gcDone; err != nil {
+		t.Fatalf("Garbage collection failed: %v", err)
+	}
+	if result.Metadata.MerkleRoot != metadata.MerkleRoot || reports != len(metadata.ChunkHashes) {
+		t.Errorf("Unexpected result: root %s, %d progress reports", result.Metadata.MerkleRoot, reports)
+	}
+
+	for _, addr := range []string{deadAddr, other.GetListenAddr(), renamed} {
+		if _, dropped := result.Dropped[addr]; !dropped {
+			t.Errorf("Expected %s to be dropped: %v", addr, result.Dropped)
+		}
+	}
+	// Stalled chunks are fetched elsewhere rather than waiting out the
+	// request timeout
+	if elapsed := time.Since(began); elapsed > wireTimeout/2 {
+		t.Errorf("Swarm download took %v", elapsed)
+	}
+	if result.Chunks[stalling] != 0 {
+		t.Errorf("Stalling peer provided %d chunks", result.Chunks[stalling])
+	}
+	sources, total := 0, 0
+	for _, count := range result.Chunks {
+		sources++
+		total += count
+	}
+	if total != len(metadata.ChunkHashes) || sources < 3 {
+		t.Errorf("Expected chunks spread across peers, got %v", result.Chunks)
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "swarm.bin")
+	if err := client.storage.ReassembleFile(result.Metadata, outputPath); err != nil {
+		t.Fatalf("Failed to reassemble file: %v", err)
+	}
+	received, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read reassembled file: %v", err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Error("Reassembled content doesn't match original")
+	}
+}
+
+func TestSwarmRoot(t *testing.T) {
+	content := make([]byte, 8*1024)
+	rand.Read(content)
+	source := startSwarmSource(t, "docs/a.bin", content)
+	metadata, err := source.storage.readMetadata("docs/a.bin")
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	// A newer version doesn't hide the old root
+	if _, err := source.storage.Ingest(bytes.NewReader([]byte("v2")), "docs/a.bin", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	client := newTestNode(t, StorageOptions{})
+
+	opts := SwarmOptions{Peers: []string{source.GetListenAddr()}}
+	result, err := client.SwarmRoot(metadata.MerkleRoot, opts)
+	if err != nil {
+		t.Fatalf("Swarm download by root failed: %v", err)
+	}
+	if result.Metadata.FileName != "docs/a.bin" || result.Metadata.Version != 1 {
+		t.Errorf("Unexpected metadata: %s version %d", result.Metadata.FileName, result.Metadata.Version)
+	}
+	for i, hash := range metadata.ChunkHashes {
+		if err := client.verifyChunk(hash); err != nil {
+			t.Errorf("Chunk %d not downloaded: %v", i, err)
+		}
+	}
+	if local, err := client.storage.readMetadata("docs/a.bin"); err != nil || local.MerkleRoot != metadata.MerkleRoot {
+		t.Errorf("Download not committed: %v", err)
+	}
+	if report, err := client.storage.CollectGarbage(GCOptions{}); err != nil || len(report.Orphaned) != 0 {
+		t.Errorf("Downloaded chunks collected as garbage: %+v, %v", report, err)
+	}
+
+	// A root nobody holds
+	_, err = client.SwarmRoot(chunkHash([]byte("unknown")), opts)
+	if !errors.Is(err, ErrChunkNotFound) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+
+	// A chunk no peer holds fails the download
+	source.storage.chunks.Delete(metadata.ChunkHashes[3])
+	client2 := newTestNode(t, StorageOptions{})
+	if _, err := client2.SwarmRoot(metadata.MerkleRoot, opts); err == nil {
+		t.Error("Expected download with a missing chunk to fail")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// unchanged reports whether a local file matches stored metadata by size,
+// mode and modification time
+func unchanged(metadata *FileMetadata, info os.FileInfo) bool {
+	attrs := metadata.Attributes
+	return attrs != nil &&
+		metadata.TotalSize == info.Size() &&
+		attrs.Mode.Perm() == info.Mode().Perm() &&
+		attrs.ModTime.Equal(info.ModTime())
+}
+
+// TreeReport summarises an ImportTree or ExportTree run
+type TreeReport struct {
+	// Files counts the regular files visited
+	Files int `json:"files"`
+	// Stored counts files ingested or written out
+	Stored int `json:"stored"`
+	// Unchanged counts files skipped because they matched by size, mode
+	// and modification time
+	Unchanged int   `json:"unchanged"`
+	Bytes     int64 `json:"bytes"`
+	// Skipped lists entries that are not regular files or directories, or
+	// whose names cannot be stored
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// ImportTree ingests every regular file below localDir under the logical
+// directory prefix, keeping relative paths, modes and modification times.
+// Files unchanged since the last import are skipped.
+func (se *StorageEngine) ImportTree(localDir, prefix string) (*TreeReport, error) {
+	if err := validateDirPath(prefix); err != nil {
+		return nil, err
+	}
+
+	report := &TreeReport{}
+	err := filepath.WalkDir(localDir, func(localPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			if prefix != "" {
+				return se.Mkdir(prefix)
+			}
+			return nil
+		}
+
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		if validateFileName(name) != nil || (!entry.IsDir() && !entry.Type().IsRegular()) {
+			report.Skipped = append(report.Skipped, localPath)
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return se.Mkdir(name)
+		}
+
+		report.Files++
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if existing, err := se.readMetadata(name); err == nil && unchanged(existing, info) {
+			report.Unchanged++
+			return nil
+		}
+
+		metadata, err := se.importFile(localPath, name, info)
+		if err != nil {
+			return err
+		}
+		report.Stored++
+		report.Bytes += metadata.TotalSize
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to import %s: %v", localDir, err)
+	}
+	return report, nil
+}
+
+func (se *StorageEngine) importFile(localPath, name string, info os.FileInfo) (*FileMetadata, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	return se.Ingest(file, name, IngestOptions{
+		ExpectedSize: info.Size(),
+		Attributes:   fileAttributes(localPath, info),
+	})
+}
+
+// ExportTree reassembles every file below the logical directory prefix into
+// localDir, restoring modes and modification times. Local files that
+// already match are left alone.
+func (se *StorageEngine) ExportTree(prefix, localDir string) (*TreeReport, error) {
+	if err := validateDirPath(prefix); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(localDir, se.dirPerm); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", localDir, err)
+	}
+
+	report := &TreeReport{}
+	if err := se.exportDir(prefix, prefix, localDir, report); err != nil {
+		return report, fmt.Errorf("failed to export %q: %v", prefix, err)
+	}
+	return report, nil
+}
+
+func (se *StorageEngine) exportDir(prefix, dir, localDir string, report *TreeReport) error {
+	entries, err := se.ListDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		rel := entry.Path
+		if prefix != "" {
+			rel = entry.Path[len(prefix)+1:]
+		}
+		localPath := filepath.Join(localDir, filepath.FromSlash(rel))
+
+		if entry.IsDir {
+			if err := os.MkdirAll(localPath, se.dirPerm); err != nil {
+				return err
+			}
+			if err := se.exportDir(prefix, entry.Path, localDir, report); err != nil {
+				return err
+			}
+			continue
+		}
+
+		report.Files++
+		metadata, err := se.readMetadata(entry.Path)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(localPath); err == nil && info.Mode().IsRegular() && unchanged(metadata, info) {
+			report.Unchanged++
+			continue
+		}
+		if err := se.exportFile(metadata, localPath); err != nil {
+			return err
+		}
+		report.Stored++
+		report.Bytes += metadata.TotalSize
+	}
+	return nil
+}
+
+// exportFile reassembles into a temporary file next to localPath and
+// renames it into place, so an interrupted export never leaves a partial
+// file behind under the real name
+func (se *StorageEngine) exportFile(metadata *FileMetadata, localPath string) error {
+	tmpPath := filepath.Join(filepath.Dir(localPath), "."+filepath.Base(localPath)+tempMarker+"export")
+	defer os.Remove(tmpPath)
+
+	if err := se.ReassembleFile(metadata, tmpPath); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, localPath)
+}
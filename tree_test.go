@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImportExportTree(t *testing.T) {
+	engine := newTestEngine(t)
+
+	src := t.TempDir()
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]struct {
+		data []byte
+		mode os.FileMode
+	}{
+		"README.md":        {[]byte("readme"), 0644},
+		"cmd/run.sh":       {[]byte("#!/bin/sh\necho run\n"), 0755},
+		"data/big/set.bin": {bytes.Repeat([]byte("x"), 5000), 0600},
+	}
+	for rel, file := range files {
+		localPath := filepath.Join(src, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(localPath), 0755)
+		if err := os.WriteFile(localPath, file.data, file.mode); err != nil {
+			t.Fatalf("Failed to write %s: %v", rel, err)
+		}
+		os.Chmod(localPath, file.mode)
+		os.Chtimes(localPath, mtime, mtime)
+	}
+	os.Mkdir(filepath.Join(src, "empty"), 0755)
+
+	report, err := engine.ImportTree(src, "project")
+	if err != nil {
+		t.Fatalf("Failed to import tree: %v", err)
+	}
+	if report.Files != 3 || report.Stored != 3 {
+		t.Errorf("Unexpected import report: %+v", report)
+	}
+	if _, err := engine.Stat("project/empty"); err != nil {
+		t.Errorf("Empty directory not imported: %v", err)
+	}
+
+	// A second run only stores what changed
+	changed := filepath.Join(src, "README.md")
+	os.WriteFile(changed, []byte("readme, revised"), 0644)
+	report, err = engine.ImportTree(src, "project")
+	if err != nil {
+		t.Fatalf("Failed to re-import tree: %v", err)
+	}
+	if report.Stored != 1 || report.Unchanged != 2 {
+		t.Errorf("Expected only the changed file to be stored: %+v", report)
+	}
+
+	dst := t.TempDir()
+	report, err = engine.ExportTree("project", dst)
+	if err != nil {
+		t.Fatalf("Failed to export tree: %v", err)
+	}
+	if report.Stored != 3 {
+		t.Errorf("Unexpected export report: %+v", report)
+	}
+	for rel, file := range files {
+		localPath := filepath.Join(dst, filepath.FromSlash(rel))
+		info, err := os.Stat(localPath)
+		if err != nil {
+			t.Fatalf("Exported file %s missing: %v", rel, err)
+		}
+		if info.Mode().Perm() != file.mode {
+			t.Errorf("Expected %s to have mode %v, got %v", rel, file.mode, info.Mode().Perm())
+		}
+		if rel != "README.md" && !info.ModTime().Equal(mtime) {
+			t.Errorf("Expected %s to have mtime %v, got %v", rel, mtime, info.ModTime())
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "README.md")); string(data) != "readme, revised" {
+		t.Errorf("Exported the stale README: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "empty")); err != nil {
+		t.Errorf("Empty directory not exported: %v", err)
+	}
+
+	report, err = engine.ExportTree("project", dst)
+	if err != nil {
+		t.Fatalf("Failed to re-export tree: %v", err)
+	}
+	if report.Stored != 0 || report.Unchanged != 3 {
+		t.Errorf("Expected a repeated export to skip every file: %+v", report)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// VersionInfo summarises one stored version of a file
+type VersionInfo struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	TotalSize int64     `json:"totalSize"`
+	FileHash  string    `json:"fileHash"`
+	// MerkleRoot identifies the version's chunk list
+	MerkleRoot string `json:"merkleRoot"`
+	Author     string `json:"author"`
+	Current    bool   `json:"current"`
+}
+
+// listVersionDocs returns every stored version of a file, oldest first
+func (se *StorageEngine) listVersionDocs(fileName string) ([]*FileMetadata, error) {
+	var versions []*FileMetadata
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		if !isFile(tx, fileName) {
+			return fmt.Errorf("no metadata for %s: %w", fileName, os.ErrNotExist)
+		}
+		var err error
+		versions, err = versionsOf(tx, fileName)
+		return err
+	})
+	return versions, err
+}
+
+// allVersionDocs returns every version of every stored file
+func (se *StorageEngine) allVersionDocs() ([]*FileMetadata, error) {
+	var all []*FileMetadata
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(versionsBucket).ForEach(func(k, v []byte) error {
+			metadata, err := decodeMetadata(v)
+			if err != nil {
+				return err
+			}
+			metadata.FileName, _ = splitVersionKey(k)
+			all = append(all, metadata)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %v", err)
+	}
+	return all, nil
+}
+
+// ListVersions returns the history of a file, oldest first
+func (se *StorageEngine) ListVersions(fileName string) ([]VersionInfo, error) {
+	current, err := se.readMetadata(fileName)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := se.listVersionDocs(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]VersionInfo, 0, len(versions))
+	for _, metadata := range versions {
+		infos = append(infos, VersionInfo{
+			Version:    metadata.Version,
+			CreatedAt:  metadata.CreatedAt,
+			TotalSize:  metadata.TotalSize,
+			FileHash:   metadata.FileHash,
+			MerkleRoot: metadata.MerkleRoot,
+			Author:     metadata.Author,
+			Current:    metadata.Version == current.Version,
+		})
+	}
+	return infos, nil
+}
+
+// ReadVersion returns the metadata of a specific version of a file
+func (se *StorageEngine) ReadVersion(fileName string, version int) (*FileMetadata, error) {
+	if err := validateFileName(fileName); err != nil {
+		return nil, err
+	}
+	var metadata *FileMetadata
+	err := se.meta.view(func(tx *bolt.Tx) error {
+		var err error
+		metadata, err = getVersion(tx, fileName, version)
+		return err
+	})
+	return metadata, err
+}
+
+func getVersion(tx *bolt.Tx, fileName string, version int) (*FileMetadata, error) {
+	data := tx.Bucket(versionsBucket).Get(versionKey(fileName, version))
+	if data == nil {
+		return nil, fmt.Errorf("version %d of %s: %w", version, fileName, os.ErrNotExist)
+	}
+	metadata, err := decodeMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	metadata.FileName = fileName
+	return metadata, nil
+}
+
+// OpenVersion returns a reader over a specific version of a file
+func (se *StorageEngine) OpenVersion(fileName string, version int) (*FileReader, error) {
+	metadata, err := se.ReadVersion(fileName, version)
+	if err != nil {
+		return nil, err
+	}
+	return se.OpenMetadata(metadata)
+}
+
+// Rollback makes an earlier version the current one. History is kept, so
+// the next ingest still gets a new, higher version number.
+func (se *StorageEngine) Rollback(fileName string, version int) (*FileMetadata, error) {
+	if err := validateFileName(fileName); err != nil {
+		return nil, err
+	}
+
+	var metadata *FileMetadata
+	err := se.meta.update(func(tx *bolt.Tx) error {
+		var err error
+		if metadata, err = getVersion(tx, fileName, version); err != nil {
+			return err
+		}
+		return putFile(tx, metadata)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// nextVersion returns the version number for a new document of fileName
+func nextVersion(tx *bolt.Tx, fileName string) (int, error) {
+	prefix := joinKey([]byte(fileName), nil)
+	latest := 0
+	err := scanPrefix(tx.Bucket(versionsBucket), prefix, func(k, _ []byte) (bool, error) {
+		_, latest = splitVersionKey(k)
+		return true, nil
+	})
+	return latest + 1, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFileVersions(t *testing.T) {
+	engine := newTestEngine(t)
+
+	first := bytes.Repeat([]byte("1"), 1500)
+	second := bytes.Repeat([]byte("2"), 2500)
+	if _, err := engine.Ingest(bytes.NewReader(first), "notes.txt", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if _, err := engine.Ingest(bytes.NewReader(second), "notes.txt", IngestOptions{}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	versions, err := engine.ListVersions("notes.txt")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("Expected 2 versions, got %d", len(versions))
+	}
+	if versions[0].Current || !versions[1].Current {
+		t.Errorf("Expected version 2 to be current: %+v", versions)
+	}
+	if versions[0].TotalSize != int64(len(first)) || versions[0].FileHash == "" || versions[0].CreatedAt.IsZero() {
+		t.Errorf("Incomplete version record: %+v", versions[0])
+	}
+
+	reader, err := engine.OpenVersion("notes.txt", 1)
+	if err != nil {
+		t.Fatalf("Failed to open version 1: %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("Failed to read version 1: %v", err)
+	}
+	if !bytes.Equal(data, first) {
+		t.Error("Version 1 contents don't match the first ingest")
+	}
+
+	if _, err := engine.Rollback("notes.txt", 1); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	current, err := engine.readMetadata("notes.txt")
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	if current.Version != 1 || current.TotalSize != int64(len(first)) {
+		t.Errorf("Expected version 1 to be current after rollback, got %d", current.Version)
+	}
+
+	third, err := engine.Ingest(bytes.NewReader([]byte("third")), "notes.txt", IngestOptions{})
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if third.Version != 3 {
+		t.Errorf("Expected new version 3 after rollback, got %d", third.Version)
+	}
+
+	// GC must keep chunks of every version, not just the current one
+	report, err := engine.CollectGarbage(GCOptions{})
+	if err != nil {
+		t.Fatalf("Failed to collect garbage: %v", err)
+	}
+	if len(report.Orphaned) != 0 {
+		t.Errorf("GC orphaned %d chunks of older versions", len(report.Orphaned))
+	}
+
+	if _, err := engine.DeleteFile("notes.txt"); err != nil {
+		t.Fatalf("Failed to delete file: %v", err)
+	}
+	if hashes, _ := engine.chunks.List(); len(hashes) != 0 {
+		t.Errorf("Expected all versions' chunks released, %d left", len(hashes))
+	}
+	if _, err := engine.ListVersions("notes.txt"); err == nil {
+		t.Error("Versions still listed after delete")
+	}
+}
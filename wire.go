@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peers speak a framed binary protocol. A connection opens with a hello of
+// wireMagic followed by the lowest and highest version the client speaks;
+// the server answers wireMagic and the version chosen, or 0 if there is
+// none in common. Every message is then one frame:
+//
+//	type         1 byte, see messageCodes
+//	request ID   4 bytes, echoed in the response
+//	data length  4 bytes
+//	payload len  4 bytes
+//	data         JSON encoded Message.Data
+//	payload      raw Message.Payload, such as chunk contents
+//
+// Integers are big endian. A connection that starts with anything but the
+// magic speaks newline separated JSON messages instead, which is easier to
+// inspect when debugging.
+const (
+	wireMagic = "DFSP"
+	// minWireVersion and maxWireVersion bound the versions this node speaks
+	minWireVersion byte = 1
+	maxWireVersion byte = 1
+
+	wireHeaderSize = 13
+	// maxFrameSize bounds the data and payload of a frame so a bad length
+	// cannot exhaust memory
+	maxFrameSize = 64 << 20
+	// wireTimeout bounds every read and write
+	wireTimeout = 10 * time.Second
+)
+
+// ErrUnsupportedVersion is returned when two peers have no protocol
+// version in common
+var ErrUnsupportedVersion = errors.New("no common protocol version")
+
+// messageCodes are the frame type codes of each message type
+var messageCodes = map[MessageType]byte{
+	Ping:                1,
+	Pong:                2,
+	FileRequest:         3,
+	FileResponse:        4,
+	ChunkRequestMessage: 5,
+	DeleteRequest:       6,
+	DeleteResponse:      7,
+	ListRequest:         8,
+	ListResponse:        9,
+	ErrorMessage:        10,
+	HaveRequest:         11,
+	HaveResponse:        12,
+}
+
+var messageTypes = func() map[byte]MessageType {
+	types := make(map[byte]MessageType, len(messageCodes))
+	for t, code := range messageCodes {
+		types[code] = t
+	}
+	return types
+}()
+
+// peerConn carries messages over a connection in the negotiated encoding.
+// A single reader keeps bytes buffered between messages. Any goroutine may
+// send, but only one may receive.
+type peerConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// version is the negotiated binary version, or 0 for JSON
+	version byte
+	dec     *json.Decoder
+	// readTimeout bounds the wait for the next message
+	readTimeout time.Duration
+
+	writeMu sync.Mutex
+	w       *bufio.Writer
+}
+
+func newPeerConn(conn net.Conn) *peerConn {
+	c := &peerConn{
+		conn:        conn,
+		r:           bufio.NewReader(conn),
+		w:           bufio.NewWriter(conn),
+		readTimeout: wireTimeout,
+	}
+	c.dec = json.NewDecoder(c.r)
+	return c
+}
+
+// dialPeer connects to a peer and negotiates the binary protocol, or
+// speaks JSON when jsonMode is set
+func dialPeer(peerAddr string, jsonMode bool) (*peerConn, error) {
+	conn, err := net.DialTimeout("tcp", peerAddr, wireTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to peer: %v", err)
+	}
+	c := newPeerConn(conn)
+	if jsonMode {
+		return c, nil
+	}
+	if err := c.negotiate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// negotiate sends the client hello and reads the version chosen
+func (c *peerConn) negotiate() error {
+	if err := c.conn.SetDeadline(time.Now().Add(wireTimeout)); err != nil {
+		return fmt.Errorf("failed to set deadline: %v", err)
+	}
+	hello := append([]byte(wireMagic), minWireVersion, maxWireVersion)
+	if _, err := c.w.Write(hello); err != nil {
+		return fmt.Errorf("failed to send hello: %v", err)
+	}
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("failed to send hello: %v", err)
+	}
+
+	reply := make([]byte, len(wireMagic)+1)
+	if _, err := io.ReadFull(c.r, reply); err != nil {
+		return fmt.Errorf("failed to receive hello: %v", err)
+	}
+	if string(reply[:len(wireMagic)]) != wireMagic {
+		return fmt.Errorf("peer does not speak the binary protocol")
+	}
+	version := reply[len(wireMagic)]
+	if version == 0 {
+		return ErrUnsupportedVersion
+	}
+	if version < minWireVersion || version > maxWireVersion {
+		return fmt.Errorf("%w: peer chose version %d", ErrUnsupportedVersion, version)
+	}
+	c.version = version
+	return nil
+}
+
+// acceptPeer detects how a connecting peer speaks and, for the binary
+// protocol, answers its hello with the highest common version
+func acceptPeer(conn net.Conn) (*peerConn, error) {
+	c := newPeerConn(conn)
+	if err := conn.SetDeadline(time.Now().Add(wireTimeout)); err != nil {
+		return nil, fmt.Errorf("failed to set deadline: %v", err)
+	}
+	first, err := c.r.Peek(1)
+	if err == io.EOF {
+		return nil, fmt.Errorf("connection closed by peer: %w", io.EOF)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hello: %w", err)
+	}
+	if first[0] != wireMagic[0] {
+		return c, nil
+	}
+
+	hello := make([]byte, len(wireMagic)+2)
+	if _, err := io.ReadFull(c.r, hello); err != nil {
+		return nil, fmt.Errorf("failed to read hello: %w", err)
+	}
+	if string(hello[:len(wireMagic)]) != wireMagic {
+		return nil, fmt.Errorf("unrecognised hello %q", hello)
+	}
+	low, high := hello[len(wireMagic)], hello[len(wireMagic)+1]
+	version := min(high, maxWireVersion)
+	if version < low || version < minWireVersion {
+		version = 0
+	}
+
+	if _, err := c.w.Write(append([]byte(wireMagic), version)); err != nil {
+		return nil, fmt.Errorf("failed to answer hello: %v", err)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to answer hello: %v", err)
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%w: peer speaks versions %d to %d", ErrUnsupportedVersion, low, high)
+	}
+	c.version = version
+	return c, nil
+}
+
+// send writes one message
+func (c *peerConn) send(msg *Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(wireTimeout)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %v", err)
+	}
+
+	if c.version == 0 {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %v", err)
+		}
+		c.w.Write(data)
+		c.w.WriteByte('\n')
+	} else {
+		code, ok := messageCodes[MessageType(msg.Type)]
+		if !ok {
+			return fmt.Errorf("failed to encode message: unknown type %q", msg.Type)
+		}
+		if len(msg.Data) > maxFrameSize || len(msg.Payload) > maxFrameSize {
+			return fmt.Errorf("failed to encode message: frame too large")
+		}
+		header := make([]byte, wireHeaderSize)
+		header[0] = code
+		binary.BigEndian.PutUint32(header[1:], msg.ID)
+		binary.BigEndian.PutUint32(header[5:], uint32(len(msg.Data)))
+		binary.BigEndian.PutUint32(header[9:], uint32(len(msg.Payload)))
+		c.w.Write(header)
+		c.w.Write(msg.Data)
+		c.w.Write(msg.Payload)
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("failed to send message: %v", err)
+	}
+	return nil
+}
+
+// receive reads one message
+func (c *peerConn) receive() (*Message, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+		return nil, fmt.Errorf("failed to set read deadline: %v", err)
+	}
+
+	if c.version == 0 {
+		var msg Message
+		if err := c.dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("connection closed by peer: %w", io.EOF)
+			}
+			return nil, fmt.Errorf("failed to decode message: %w", err)
+		}
+		return &msg, nil
+	}
+
+	header := make([]byte, wireHeaderSize)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("connection closed by peer: %w", io.EOF)
+		}
+		return nil, fmt.Errorf("failed to read frame header: %w", err)
+	}
+	msgType, ok := messageTypes[header[0]]
+	if !ok {
+		return nil, fmt.Errorf("failed to decode message: unknown type code %d", header[0])
+	}
+	dataLen := binary.BigEndian.Uint32(header[5:])
+	payloadLen := binary.BigEndian.Uint32(header[9:])
+	if dataLen > maxFrameSize || payloadLen > maxFrameSize {
+		return nil, fmt.Errorf("failed to decode message: frame too large")
+	}
+
+	msg := &Message{Type: string(msgType), ID: binary.BigEndian.Uint32(header[1:])}
+	body := make([]byte, dataLen+payloadLen)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, fmt.Errorf("failed to read frame: %w", err)
+	}
+	if dataLen > 0 {
+		msg.Data = body[:dataLen]
+	}
+	if payloadLen > 0 {
+		msg.Payload = body[dataLen:]
+	}
+	return msg, nil
+}
+
+// reply sends the response to the request with the given ID
+func (c *peerConn) reply(id uint32, response *Message) error {
+	response.ID = id
+	return c.send(response)
+}
+
+func (c *peerConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pipePeers connects a client and server peerConn over an in-memory pipe
+func pipePeers(t *testing.T, jsonMode bool) (client, server *peerConn) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	accepted := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = acceptPeer(serverConn)
+		accepted <- err
+	}()
+	client = newPeerConn(clientConn)
+	if !jsonMode {
+		if err := client.negotiate(); err != nil {
+			t.Fatalf("Negotiation failed: %v", err)
+		}
+	} else {
+		// Detection needs a first byte before acceptPeer returns
+		go client.send(NewMessage(Ping, nil))
+	}
+	if err := <-accepted; err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	if jsonMode {
+		if msg, err := server.receive(); err != nil || msg.Type != string(Ping) {
+			t.Fatalf("Failed to receive ping: %v", err)
+		}
+	}
+	return client, server
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	for _, jsonMode := range []bool{false, true} {
+		client, server := pipePeers(t, jsonMode)
+		if !jsonMode && (client.version != maxWireVersion || server.version != maxWireVersion) {
+			t.Errorf("Negotiated versions %d and %d", client.version, server.version)
+		}
+
+		payload := bytes.Repeat([]byte{0, 1, 2, 0xff}, 1000)
+		sent := []*Message{NewMessage(FileRequest, "a.txt"), NewMessage(FileResponse, ChunkResponse{Hash: "h"})}
+		sent[1].Payload = payload
+		sent[1].ID = 7
+
+		// Both messages are buffered before either is read, so a reader
+		// must not lose the second one
+		go func() {
+			for _, msg := range sent {
+				client.send(msg)
+			}
+		}()
+		for i, want := range sent {
+			got, err := server.receive()
+			if err != nil {
+				t.Fatalf("json=%v: failed to receive message %d: %v", jsonMode, i, err)
+			}
+			if got.Type != want.Type || got.ID != want.ID || !bytes.Equal(got.Data, want.Data) || !bytes.Equal(got.Payload, want.Payload) {
+				t.Errorf("json=%v: message %d changed in transit: %+v", jsonMode, i, got)
+			}
+		}
+	}
+}
+
+func TestWireVersionNegotiation(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := acceptPeer(serverConn)
+		accepted <- err
+	}()
+
+	// A client that only speaks future versions is turned away
+	clientConn.Write(append([]byte(wireMagic), 7, 9))
+	reply := make([]byte, len(wireMagic)+1)
+	if _, err := io.ReadFull(clientConn, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if reply[len(wireMagic)] != 0 {
+		t.Errorf("Expected no common version, server chose %d", reply[len(wireMagic)])
+	}
+	if err := <-accepted; !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestWireReceiveErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	connect := func(jsonMode bool) (client, server *peerConn) {
+		t.Helper()
+		accepted := make(chan *peerConn, 1)
+		go func() {
+			netConn, err := ln.Accept()
+			if err != nil {
+				accepted <- nil
+				return
+			}
+			server, _ := acceptPeer(netConn)
+			accepted <- server
+		}()
+		client, err := dialPeer(ln.Addr().String(), jsonMode)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		if jsonMode {
+			// Detection needs a first byte before acceptPeer returns
+			client.send(NewMessage(Ping, nil))
+		}
+		if server = <-accepted; server == nil {
+			t.Fatal("Accept failed")
+		}
+		t.Cleanup(func() { server.Close() })
+		if jsonMode {
+			server.receive()
+		}
+		return client, server
+	}
+
+	for _, jsonMode := range []bool{false, true} {
+		// An idle connection times out
+		_, server := connect(jsonMode)
+		server.readTimeout = 10 * time.Millisecond
+		_, err := server.receive()
+		if !errors.Is(err, os.ErrDeadlineExceeded) || !closedNormally(err) {
+			t.Errorf("json=%v: expected a deadline error, got %v", jsonMode, err)
+		}
+
+		// A peer closing between messages is a clean end
+		client, server := connect(jsonMode)
+		client.Close()
+		_, err = server.receive()
+		if !errors.Is(err, io.EOF) || !closedNormally(err) {
+			t.Errorf("json=%v: expected EOF, got %v", jsonMode, err)
+		}
+	}
+}